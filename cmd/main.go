@@ -4,7 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/allan-deng/redis-id-generator/internal/generator"
@@ -24,10 +26,23 @@ func main() {
 	confInit()
 	logInit()
 	generator.IdGenInit()
+	signalHandle()
 	pprofRun()
+	adminRun()
 	serverRun()
 }
 
+func signalHandle() {
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-c
+		log.Infof("receive signal %v, exit.", sig)
+		generator.Close()
+		os.Exit(0)
+	}()
+}
+
 func pprofRun() {
 	go func() {
 		env := viper.GetString("app.env")
@@ -38,6 +53,27 @@ func pprofRun() {
 	}()
 }
 
+// adminRun serves the admin api on admin.addr, it is not served without admin.token.
+func adminRun() {
+	addr := viper.GetString("admin.addr")
+	token := viper.GetString("admin.token")
+	if addr == "" {
+		return
+	}
+	if token == "" {
+		log.Warnf("admin.token is empty, the admin api on %v is not served.", addr)
+		return
+	}
+
+	r := router.GetAdminRouter(token)
+	go func() {
+		log.Infof("admin api on %v.", addr)
+		if err := fasthttp.ListenAndServe(addr, r.Handler); err != nil {
+			log.Fatalf("admin api on %v failed: %v.", addr, err)
+		}
+	}()
+}
+
 func serverRun() {
 	r := router.GetRouter()
 	ip := viper.GetString("app.ip")
@@ -1,8 +1,11 @@
 package generator
 
 import (
+	"context"
+	"fmt"
 	"time"
 
+	"github.com/allan-deng/redis-id-generator/internal/metrics"
 	"github.com/allan-deng/redis-id-generator/pkg/idgen"
 
 	log "github.com/sirupsen/logrus"
@@ -11,17 +14,79 @@ import (
 	"github.com/spf13/viper"
 )
 
+const DefaultMaxBatchCount = 1000
+
 var IdGen *idgen.IdGenerator
 
-func IdGenInit() {
-	addr := viper.GetString("redis.addr")
-	pwd := viper.GetString("redis.password")
+// AdminStore manages the bizTags of IdGen in redis
+var AdminStore idgen.AdminStore
+
+// Snowflake serves the bizTags configured in snowflake.biztags, nil when there is none
+var Snowflake *idgen.SnowflakeGenerator
+var snowflakeTags = make(map[string]struct{})
+
+// encoders of the string id formats, keyed by format name
+var encoders = make(map[string]idgen.IdEncoder)
+
+// IdFormat is the default format of ids in responses, "number" or a string id format
+var IdFormat = "number"
+
+// feistel is the cipher of the default feistel filter, nil when the filter is not used
+var feistel *idgen.FeistelCipher
+
+// bizTagFeistels are the ciphers of the bizTags configured with their own
+// filter in idgen.biztags, nil when the bizTag does not use the feistel filter
+var bizTagFeistels = make(map[string]*idgen.FeistelCipher)
+
+// bizTagFormats are the default id formats of the bizTags configured in idgen.biztags
+var bizTagFormats = make(map[string]string)
+
+// bizTagConf is an entry of idgen.biztags, the settings of one bizTag that
+// differ from the [idgen] defaults. Unset fields fall back to the defaults.
+type bizTagConf struct {
+	BizTag            string  `mapstructure:"biztag"`
+	Step              int64   `mapstructure:"step"`
+	PreloadRetryTimes *int    `mapstructure:"preload_retry_times"`
+	PreloadTimeout    int64   `mapstructure:"preload_timeout"`     // unit: ms
+	PreloadBackoff    int64   `mapstructure:"preload_backoff"`     // unit: ms
+	PreloadMaxBackoff int64   `mapstructure:"preload_max_backoff"` // unit: ms
+	StepDuration      *int64  `mapstructure:"step_duration"`       // unit: s, 0 turns the adaptive step off
+	MinStep           int64   `mapstructure:"min_step"`
+	Filter            string  `mapstructure:"filter"`
+	FeistelKey        string  `mapstructure:"feistel_key"` // default: idgen.feistel_key
+	IdFormat          string  `mapstructure:"id_format"`   // default: app.id_format
+	LockFree          *bool   `mapstructure:"lock_free"`
+	PrefetchSegments  int     `mapstructure:"prefetch_segments"`
+	PreloadRatio      float64 `mapstructure:"preload_ratio"`
+	PreloadTime       *int64  `mapstructure:"preload_time"` // unit: s, 0 goes back to preload_ratio
+}
+
+// preloadBackoff returns the preload backoffs given in ms, falling back to
+// idgen.preload_backoff and idgen.preload_max_backoff, then to the defaults.
+func preloadBackoff(backoff int64, maxBackoff int64) (time.Duration, time.Duration) {
+	if backoff <= 0 {
+		backoff = viper.GetInt64("idgen.preload_backoff")
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = viper.GetInt64("idgen.preload_max_backoff")
+	}
+	if backoff <= 0 && maxBackoff > 0 {
+		backoff = idgen.DefaultPreloadBackoff.Milliseconds()
+	}
+	if maxBackoff <= 0 && backoff > 0 {
+		maxBackoff = idgen.DefaultPreloadMaxBackoff.Milliseconds()
+	}
+	return time.Duration(backoff) * time.Millisecond, time.Duration(maxBackoff) * time.Millisecond
+}
+
+// workerLease is the worker id lease of Snowflake, nil when the worker id is configured
+var workerLease *idgen.RedisWorkerLease
 
-	client := redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Password: pwd,
-		DB:       0,
-	})
+// MaxBatchCount is the maximum number of ids that can be allocated in one batch request
+var MaxBatchCount = DefaultMaxBatchCount
+
+func IdGenInit() {
+	client, addr := newRedisClient()
 	// check redis connect status...
 	_, err := client.Ping(client.Context()).Result()
 	if err != nil {
@@ -30,10 +95,17 @@ func IdGenInit() {
 
 	log.Infof("connect to redis %v succ", addr)
 
-	store := idgen.NewRedisIdStore(client)
-
 	opts := make([]idgen.Option, 0)
-	opts = append(opts, idgen.With2BytesRandomFilter())
+	filter := viper.GetString("idgen.filter")
+	if filter == "" {
+		filter = "random16"
+	}
+	filters, cipher, err := newFilters(filter, viper.GetString("idgen.feistel_key"))
+	if err != nil {
+		log.Fatalf("invalid idgen.filter: %v.", err)
+	}
+	feistel = cipher
+	opts = append(opts, idgen.WithIdFilter(filters))
 
 	if retry_times := viper.GetInt("idgen.preload_retry_times"); retry_times > 0 {
 		opts = append(opts, idgen.WithPreloadRetryTimes(retry_times))
@@ -44,9 +116,373 @@ func IdGenInit() {
 	if timeout := viper.GetDuration("idgen.preload_timeout") * time.Millisecond; timeout > 0 {
 		opts = append(opts, idgen.WithPreloadTimeout(timeout))
 	}
-	if expire := viper.GetDuration("idgen.biztag_expire_time")* time.Second; expire > 0 {
+	if backoff, maxBackoff := preloadBackoff(0, 0); backoff > 0 || maxBackoff > 0 {
+		opts = append(opts, idgen.WithPreloadBackoff(backoff, maxBackoff))
+	}
+	if ratio := viper.GetFloat64("idgen.preload_ratio"); ratio > 0 {
+		opts = append(opts, idgen.WithPreloadRatio(ratio))
+	}
+	if d := viper.GetDuration("idgen.preload_time") * time.Second; d > 0 {
+		opts = append(opts, idgen.WithPreloadTime(d))
+	}
+	if n := viper.GetInt("idgen.prefetch_segments"); n > 0 {
+		opts = append(opts, idgen.WithPrefetch(n))
+	}
+	if viper.GetBool("idgen.lock_free") {
+		opts = append(opts, idgen.WithLockFree())
+	}
+	if timeout := viper.GetDuration("idgen.wait_timeout") * time.Millisecond; timeout > 0 {
+		opts = append(opts, idgen.WithWaitTimeout(timeout))
+	}
+	if expire := viper.GetDuration("idgen.biztag_expire_time") * time.Second; expire > 0 {
 		opts = append(opts, idgen.WithExpireTime(expire))
 	}
+	if duration := viper.GetDuration("idgen.step_duration") * time.Second; duration > 0 {
+		opts = append(opts, idgen.WithAdaptiveStep(duration, viper.GetInt64("idgen.min_step")))
+	}
+
+	if path := viper.GetString("idgen.watermark_file"); path != "" {
+		opts = append(opts, watermarkInit(path))
+	}
+
+	if count := viper.GetInt("idgen.max_batch_count"); count > 0 {
+		MaxBatchCount = min(count, idgen.MaxIdCount)
+	}
 
+	opts = append(opts, bizTagInit()...)
+	for bizTag := range bizTagFormats {
+		metrics.AddBizTags(bizTag)
+	}
+	metrics.AddBizTags(viper.GetStringSlice("idgen.biztag_allowlist")...)
+	opts = append(opts, idgen.WithObserver(logObserver{}), idgen.WithObserver(metrics.Observer{}))
+
+	store := newStore(client)
+	AdminStore = store
 	IdGen = idgen.NewIdGenrator(store, opts...)
+	metrics.RegisterStats(IdGen.Stats)
+
+	snowflakeInit(client)
+	encoderInit()
+}
+
+// bizTagInit parses idgen.biztags into per bizTag options.
+func bizTagInit() []idgen.Option {
+	var confs []bizTagConf
+	if err := viper.UnmarshalKey("idgen.biztags", &confs); err != nil {
+		log.Fatalf("invalid idgen.biztags: %v.", err)
+	}
+
+	opts := make([]idgen.Option, 0, len(confs))
+	for _, conf := range confs {
+		if conf.BizTag == "" {
+			log.Fatalf("biztag is required by idgen.biztags entries.")
+		}
+		if _, ok := bizTagFormats[conf.BizTag]; ok {
+			log.Fatalf("duplicate biztag %v in idgen.biztags.", conf.BizTag)
+		}
+		bizTagFormats[conf.BizTag] = conf.IdFormat
+
+		bizTagOpts := make([]idgen.BizTagOption, 0)
+		if conf.Step > 0 {
+			bizTagOpts = append(bizTagOpts, idgen.WithBizTagStep(conf.Step))
+		}
+		if conf.PreloadRetryTimes != nil {
+			bizTagOpts = append(bizTagOpts, idgen.WithBizTagPreloadRetryTimes(*conf.PreloadRetryTimes))
+		}
+		if conf.PreloadTimeout > 0 {
+			bizTagOpts = append(bizTagOpts, idgen.WithBizTagPreloadTimeout(time.Duration(conf.PreloadTimeout)*time.Millisecond))
+		}
+		if conf.PreloadBackoff > 0 || conf.PreloadMaxBackoff > 0 {
+			bizTagOpts = append(bizTagOpts, idgen.WithBizTagPreloadBackoff(preloadBackoff(conf.PreloadBackoff, conf.PreloadMaxBackoff)))
+		}
+		if conf.StepDuration != nil {
+			bizTagOpts = append(bizTagOpts, idgen.WithBizTagAdaptiveStep(time.Duration(*conf.StepDuration)*time.Second, conf.MinStep))
+		}
+		if conf.PreloadRatio > 0 {
+			bizTagOpts = append(bizTagOpts, idgen.WithBizTagPreloadRatio(conf.PreloadRatio))
+		}
+		if conf.PreloadTime != nil {
+			bizTagOpts = append(bizTagOpts, idgen.WithBizTagPreloadTime(time.Duration(*conf.PreloadTime)*time.Second))
+		}
+		if conf.PrefetchSegments > 0 {
+			bizTagOpts = append(bizTagOpts, idgen.WithBizTagPrefetch(conf.PrefetchSegments))
+		}
+		if conf.LockFree != nil {
+			bizTagOpts = append(bizTagOpts, idgen.WithBizTagLockFree(*conf.LockFree))
+		}
+		if conf.Filter != "" {
+			key := conf.FeistelKey
+			if key == "" {
+				key = viper.GetString("idgen.feistel_key")
+			}
+			filters, cipher, err := newFilters(conf.Filter, key)
+			if err != nil {
+				log.Fatalf("invalid filter of biztag %v: %v.", conf.BizTag, err)
+			}
+			bizTagFeistels[conf.BizTag] = cipher
+			bizTagOpts = append(bizTagOpts, idgen.WithBizTagIdFilter(filters))
+		}
+
+		opts = append(opts, idgen.WithBizTagConfig(conf.BizTag, bizTagOpts...))
+		log.Infof("biztag %v config loaded", conf.BizTag)
+	}
+	return opts
+}
+
+// watermarkInit returns the option checking the segments against the high
+// water marks in the file at path, with idgen.watermark_policy: refuse
+// (default) or bump. The file only knows the segments of this node, bump is
+// only safe when this node is the only one serving the ids.
+func watermarkInit(path string) idgen.Option {
+	store, err := idgen.NewFileWatermarkStore(path)
+	if err != nil {
+		log.Fatalf("invalid idgen.watermark_file: %v.", err)
+	}
+
+	name := viper.GetString("idgen.watermark_policy")
+	if name == "" {
+		name = "refuse"
+	}
+	var policy idgen.WatermarkPolicy
+	switch name {
+	case "bump":
+		policy = idgen.WatermarkBump
+		log.Warnf("idgen.watermark_policy bump only protects a single node, the marks in %v do not cover the segments of the other nodes.", path)
+	case "refuse":
+		policy = idgen.WatermarkRefuse
+	default:
+		log.Fatalf("invalid idgen.watermark_policy: %v.", name)
+	}
+	log.Infof("high water marks in %v, policy: %v.", path, name)
+	return idgen.WithWatermark(store, policy)
+}
+
+// newRedisClient returns the client of redis.addr, or of the master named
+// redis.master_name through the sentinels redis.sentinel_addrs. The address
+// is returned for the logs.
+func newRedisClient() (*redis.Client, string) {
+	pwd := viper.GetString("redis.password")
+	masterName := viper.GetString("redis.master_name")
+	if masterName == "" {
+		addr := viper.GetString("redis.addr")
+		return redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: pwd,
+			DB:       0,
+		}), addr
+	}
+
+	sentinels := viper.GetStringSlice("redis.sentinel_addrs")
+	return redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:       masterName,
+		SentinelAddrs:    sentinels,
+		SentinelPassword: viper.GetString("redis.sentinel_password"),
+		Password:         pwd,
+		DB:               0,
+	}), fmt.Sprintf("%v via sentinels %v", masterName, sentinels)
+}
+
+// newStore returns the redis store of IdGen. With idgen.strict_biztags only
+// the bizTags of idgen.biztag_allowlist and idgen.biztags are created on
+// their first request, the others have to be created by the admin api.
+// With redis.failover_bump_steps the bizTags are bumped when the master changes.
+func newStore(client *redis.Client) *idgen.RedisIdStore {
+	opts := make([]idgen.RedisStoreOption, 0)
+	if viper.GetBool("idgen.strict_biztags") {
+		allowlist := viper.GetStringSlice("idgen.biztag_allowlist")
+		for bizTag := range bizTagFormats {
+			allowlist = append(allowlist, bizTag)
+		}
+		log.Infof("strict biztags, allowlist: %v.", allowlist)
+		opts = append(opts, idgen.WithStrictBizTags(allowlist...))
+	}
+	if steps := viper.GetInt64("redis.failover_bump_steps"); steps > 0 {
+		opts = append(opts, idgen.WithFailoverBump(steps, func(e idgen.FailoverEvent) {
+			if e.Err != nil {
+				log.Errorf("redis master not checked, segment fetch failed: %v.", e.Err)
+				return
+			}
+			log.Warnf("redis master changed, run_id: %v -> %v, biztags bumped by %v steps, max: %v.", e.OldRunId, e.NewRunId, steps, e.Bumped)
+		}))
+	}
+	return idgen.NewRedisIdStore(client, opts...)
+}
+
+// newFilters returns the filters of a filter name: random16, feistel or none.
+// The cipher is returned with the feistel filter, nil with the others.
+func newFilters(filter string, feistelKey string) ([]idgen.IdFilter, *idgen.FeistelCipher, error) {
+	switch filter {
+	case "random16":
+		return []idgen.IdFilter{idgen.AddRandomFilter(16)}, nil, nil
+	case "feistel":
+		if feistelKey == "" {
+			return nil, nil, fmt.Errorf("feistel_key is required by feistel filter")
+		}
+		cipher := idgen.NewFeistelCipher([]byte(feistelKey))
+		return []idgen.IdFilter{cipher.Encode}, cipher, nil
+	case "none":
+		return nil, nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown filter: %v", filter)
+}
+
+// Close releases the resources held by the generators, it is called on shutdown.
+func Close() {
+	if workerLease != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := workerLease.Release(ctx); err != nil {
+			log.Errorf("release worker id %v failed: %v.", workerLease.WorkerId(), err)
+			return
+		}
+		log.Infof("worker id lease released.")
+	}
+}
+
+func snowflakeInit(client *redis.Client) {
+	tags := viper.GetStringSlice("snowflake.biztags")
+	if len(tags) == 0 {
+		return
+	}
+
+	// The bits left unset keep their defaults, the worker bits are shared by
+	// the layout and the lease.
+	timeBits := snowflakeBits("snowflake.time_bits", idgen.DefaultSnowflakeTimeBits)
+	workerBits := snowflakeBits("snowflake.worker_bits", idgen.DefaultSnowflakeWorkerBits)
+	seqBits := snowflakeBits("snowflake.seq_bits", idgen.DefaultSnowflakeSeqBits)
+
+	opts := make([]idgen.SnowflakeOption, 0)
+	opts = append(opts, idgen.WithSnowflakeLayout(timeBits, workerBits, seqBits))
+	if epoch := viper.GetInt64("snowflake.epoch"); epoch > 0 {
+		opts = append(opts, idgen.WithSnowflakeEpoch(time.UnixMilli(epoch)))
+	}
+	if viper.IsSet("snowflake.max_clock_backward") {
+		opts = append(opts, idgen.WithMaxClockBackward(viper.GetDuration("snowflake.max_clock_backward")*time.Millisecond))
+	}
+
+	workerId := viper.GetInt64("snowflake.worker_id")
+	if viper.GetBool("snowflake.worker_lease") {
+		leaseOpts := make([]idgen.WorkerLeaseOption, 0)
+		if ttl := viper.GetDuration("snowflake.lease_ttl") * time.Second; ttl > 0 {
+			leaseOpts = append(leaseOpts, idgen.WithLeaseTTL(ttl))
+		}
+		var err error
+		workerLease, err = idgen.NewRedisWorkerLease(client, 1<<workerBits, leaseOpts...)
+		if err != nil {
+			log.Fatalf("init worker id lease failed: %v.", err)
+		}
+		workerId, err = workerLease.Acquire(client.Context())
+		if err != nil {
+			log.Fatalf("acquire worker id lease failed: %v.", err)
+		}
+		opts = append(opts, idgen.WithWorkerLease(workerLease))
+		log.Infof("acquire worker id lease succ, worker id: %v", workerId)
+	}
+
+	var err error
+	Snowflake, err = idgen.NewSnowflakeGenerator(workerId, opts...)
+	if err != nil {
+		log.Fatalf("init snowflake generator failed: %v.", err)
+	}
+
+	for _, tag := range tags {
+		snowflakeTags[tag] = struct{}{}
+	}
+	log.Infof("snowflake generator init succ, worker id: %v, biztags: %v", workerId, tags)
+}
+
+// snowflakeBits returns the bits of the snowflake layout at key, def when unset.
+func snowflakeBits(key string, def uint) uint {
+	if !viper.IsSet(key) {
+		return def
+	}
+	return viper.GetUint(key)
+}
+
+// Get returns the generator of the bizTag: snowflake for the bizTags
+// configured in snowflake.biztags, segment mode for the others.
+func Get(bizTag string) idgen.Generator {
+	if _, ok := snowflakeTags[bizTag]; ok {
+		return Snowflake
+	}
+	return IdGen
+}
+
+func encoderInit() {
+	base62, err := idgen.NewBase62Encoder(viper.GetString("encoder.base62_alphabet"))
+	if err != nil {
+		log.Fatalf("init base62 encoder failed: %v.", err)
+	}
+
+	var blocklist []string
+	if viper.IsSet("encoder.sqids_blocklist") {
+		blocklist = viper.GetStringSlice("encoder.sqids_blocklist")
+	}
+	sqids, err := idgen.NewSqidsEncoder(
+		viper.GetString("encoder.sqids_alphabet"),
+		uint8(viper.GetUint("encoder.sqids_min_length")),
+		blocklist,
+	)
+	if err != nil {
+		log.Fatalf("init sqids encoder failed: %v.", err)
+	}
+
+	encoders["decimal"] = idgen.DecimalEncoder{}
+	encoders["string"] = idgen.DecimalEncoder{}
+	encoders["base62"] = base62
+	encoders["base32"] = idgen.NewCrockford32Encoder()
+	encoders["sqids"] = sqids
+
+	if format := viper.GetString("app.id_format"); format != "" && format != IdFormat {
+		if _, err := Encoder(format); err != nil {
+			log.Fatalf("invalid app.id_format: %v.", err)
+		}
+		IdFormat = format
+	}
+	for bizTag, format := range bizTagFormats {
+		if format == "" || format == "number" {
+			continue
+		}
+		if _, err := Encoder(format); err != nil {
+			log.Fatalf("invalid id_format of biztag %v: %v.", bizTag, err)
+		}
+	}
+}
+
+// FormatOf returns the default id format of the bizTag, the id_format of its
+// idgen.biztags entry or app.id_format.
+func FormatOf(bizTag string) string {
+	if format := bizTagFormats[bizTag]; format != "" {
+		return format
+	}
+	return IdFormat
+}
+
+// Encoder returns the encoder of a string id format: string (decimal), decimal, base62, base32 or sqids.
+func Encoder(format string) (idgen.IdEncoder, error) {
+	if encoder, ok := encoders[format]; ok {
+		return encoder, nil
+	}
+	return nil, fmt.Errorf("unknown id format: %v", format)
+}
+
+// DecodeId recovers the raw segment id of a public id of the bizTag,
+// it is only available with the feistel filter.
+func DecodeId(bizTag string, id int64) (int64, error) {
+	cipher := feistel
+	if c, ok := bizTagFeistels[bizTag]; ok {
+		cipher = c
+	}
+	if _, ok := snowflakeTags[bizTag]; ok || cipher == nil {
+		return 0, fmt.Errorf("ids of biztag %v can not be decoded", bizTag)
+	}
+	return cipher.Decode(id)
+}
+
+// HasFilter reports whether the ids of the bizTag are post-processed by filters.
+func HasFilter(bizTag string) bool {
+	if _, ok := snowflakeTags[bizTag]; ok {
+		return false
+	}
+	return IdGen.HasFilter(bizTag)
 }
@@ -0,0 +1,25 @@
+package generator
+
+import (
+	"github.com/allan-deng/redis-id-generator/pkg/idgen"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logObserver logs the events of the id allocators. Failures are logged as
+// warnings, the segment switches, which happen on every segment, as debug.
+// A segment below the high water mark means redis lost ids, it is an error.
+type logObserver struct{}
+
+func (logObserver) Observe(e idgen.Event) {
+	switch e.Type {
+	case idgen.EventWatermarkViolated:
+		log.Errorf("idgen %v, biz tag: %v, seg: (%v, %v], err: %v.", e.Type, e.BizTag, e.MinId, e.MaxId, e.Err)
+	case idgen.EventPreloadFailed, idgen.EventWaitTimeout:
+		log.Warnf("idgen %v, biz tag: %v, seg: (%v, %v], latency: %v, err: %v.", e.Type, e.BizTag, e.MinId, e.MaxId, e.Latency, e.Err)
+	case idgen.EventSegmentSwitched:
+		log.Debugf("idgen %v, biz tag: %v, seg: (%v, %v], latency: %v.", e.Type, e.BizTag, e.MinId, e.MaxId, e.Latency)
+	default:
+		log.Infof("idgen %v, biz tag: %v, seg: (%v, %v], latency: %v.", e.Type, e.BizTag, e.MinId, e.MaxId, e.Latency)
+	}
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/allan-deng/redis-id-generator/pkg/idgen"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+const namespace = "idgen"
+
+// unknownBizTag is the label of the bizTags neither served nor configured, so
+// that the requests for arbitrary bizTags do not create unbounded series.
+const unknownBizTag = "unknown"
+
+// bizTags are the bizTags used as labels, see AddBizTags.
+var bizTags sync.Map
+
+var (
+	idsIssued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ids_issued_total",
+		Help:      "Number of ids issued.",
+	}, []string{"biztag"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of GetId (api id) and GetIds (api ids).",
+		Buckets:   prometheus.ExponentialBuckets(0.00005, 4, 8), // 50us to 0.8s
+	}, []string{"biztag", "api"})
+
+	segmentFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "segment_fetches_total",
+		Help:      "Number of segments fetched from the store.",
+	}, []string{"biztag"})
+
+	segmentFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "segment_fetch_duration_seconds",
+		Help:      "Latency of the fetches of segments from the store, retries included.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"biztag"})
+
+	preloadFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "preload_failures_total",
+		Help:      "Number of fetches of segments that failed after the retries.",
+	}, []string{"biztag"})
+
+	waitTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "wait_timeouts_total",
+		Help:      "Number of requests that gave up waiting for the next segment.",
+	}, []string{"biztag"})
+
+	watermarkViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watermark_violations_total",
+		Help:      "Number of segments from redis not above the high water mark.",
+	}, []string{"biztag"})
+
+	remainingIdsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "remaining_ids"),
+		"Number of ids left in the segment in use (segment current) and in the preloaded segments (segment next).",
+		[]string{"biztag", "segment"}, nil,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(idsIssued, requestDuration, segmentFetches, segmentFetchDuration, preloadFailures, waitTimeouts, watermarkViolations)
+}
+
+// Handler serves the metrics in the Prometheus format.
+func Handler() fasthttp.RequestHandler {
+	return fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+}
+
+// AddBizTags labels the metrics of bizTags, they are the configured ones.
+// The other bizTags are labeled once ids of them are served, and as
+// unknown until then.
+func AddBizTags(tags ...string) {
+	for _, bizTag := range tags {
+		bizTags.Store(bizTag, struct{}{})
+	}
+}
+
+func label(bizTag string) string {
+	if _, ok := bizTags.Load(bizTag); ok {
+		return bizTag
+	}
+	return unknownBizTag
+}
+
+// ObserveRequest records a request of api that issued n ids of bizTag in d.
+func ObserveRequest(api string, bizTag string, n int, d time.Duration) {
+	if n > 0 {
+		AddBizTags(bizTag)
+	}
+	requestDuration.WithLabelValues(label(bizTag), api).Observe(d.Seconds())
+	if n > 0 {
+		idsIssued.WithLabelValues(label(bizTag)).Add(float64(n))
+	}
+}
+
+// Observer turns the events of the id allocators into metrics.
+type Observer struct{}
+
+func (Observer) Observe(e idgen.Event) {
+	switch e.Type {
+	case idgen.EventSegmentFetched:
+		AddBizTags(e.BizTag)
+		segmentFetches.WithLabelValues(e.BizTag).Inc()
+		segmentFetchDuration.WithLabelValues(e.BizTag).Observe(e.Latency.Seconds())
+	case idgen.EventPreloadFailed:
+		preloadFailures.WithLabelValues(label(e.BizTag)).Inc()
+		segmentFetchDuration.WithLabelValues(label(e.BizTag)).Observe(e.Latency.Seconds())
+	case idgen.EventWaitTimeout:
+		waitTimeouts.WithLabelValues(label(e.BizTag)).Inc()
+	case idgen.EventWatermarkViolated:
+		watermarkViolations.WithLabelValues(label(e.BizTag)).Inc()
+	}
+}
+
+// RegisterStats exports the remaining ids of the bizTags returned by stats,
+// it is read at each scrape.
+func RegisterStats(stats func() []idgen.BizTagStats) {
+	prometheus.MustRegister(statsCollector(stats))
+}
+
+type statsCollector func() []idgen.BizTagStats
+
+func (this statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- remainingIdsDesc
+}
+
+func (this statsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range this() {
+		ch <- prometheus.MustNewConstMetric(remainingIdsDesc, prometheus.GaugeValue, float64(s.Remaining), s.BizTag, "current")
+		ch <- prometheus.MustNewConstMetric(remainingIdsDesc, prometheus.GaugeValue, float64(s.NextRemaining), s.BizTag, "next")
+	}
+}
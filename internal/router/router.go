@@ -2,18 +2,20 @@ package router
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
-	"reflect"
 	"runtime/debug"
 	"sync"
 	"time"
 	"unsafe"
 
+	"github.com/allan-deng/redis-id-generator/internal/metrics"
 	"github.com/allan-deng/redis-id-generator/internal/service"
 
 	"github.com/buaazp/fasthttprouter"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	"github.com/valyala/fasthttp"
 )
 
@@ -44,21 +46,53 @@ func GetRouter() *fasthttprouter.Router {
 	AddFilter(recoverFilter)
 	AddFilter(debugLogFilter)
 	RegisterHander(GETMETHOD, "/id", service.GetIdHandler)
+	RegisterHander(GETMETHOD, "/ids", service.GetIdsHandler)
+	// Served as is, without the filters: the debug log would dump every scrape.
+	if !viper.IsSet("app.metrics") || viper.GetBool("app.metrics") {
+		svrRouter.GET("/metrics", metrics.Handler())
+	}
 
 	return svrRouter
 }
 
+// GetAdminRouter returns the router of the admin listener, every request
+// must carry the header "Authorization: Bearer <token>".
+func GetAdminRouter(token string) *fasthttprouter.Router {
+	r := fasthttprouter.New()
+	filters := []Filter{recoverFilter, debugLogFilter, authFilter(token)}
+
+	// Decoding reveals the raw sequence, it is only served when enabled explicitly.
+	if viper.GetBool("idgen.decode_api") {
+		register(r, filters, GETMETHOD, "/decode", service.DecodeIdHandler)
+	}
+	// The state of the allocators, read only.
+	register(r, filters, GETMETHOD, "/admin/stats", service.StatsHandler)
+	register(r, filters, GETMETHOD, "/admin/biztag", service.BizTagHandler)
+	register(r, filters, POSTMETHOD, "/admin/biztag/create", service.CreateBizTagHandler)
+	register(r, filters, POSTMETHOD, "/admin/biztag/step", service.SetStepHandler)
+	register(r, filters, POSTMETHOD, "/admin/biztag/disable", service.DisableBizTagHandler)
+	register(r, filters, POSTMETHOD, "/admin/biztag/enable", service.EnableBizTagHandler)
+	register(r, filters, POSTMETHOD, "/admin/biztag/archive", service.ArchiveBizTagHandler)
+	register(r, filters, POSTMETHOD, "/admin/biztag/delete", service.DeleteBizTagHandler)
+
+	return r
+}
+
 func RegisterHander(method int, path string, handler Handler) {
+	register(svrRouter, filterList, method, path, handler)
+}
+
+func register(r *fasthttprouter.Router, filters []Filter, method int, path string, handler Handler) {
 	if method <= NONEMETHOD || method >= MAXMETHOD {
 		panic(fmt.Sprintf("register unsupport method %v, path %v!", method, path))
 	}
 	wrappedHandler := handlerWrapper(handler)
-	hanflerChains := processFilter(wrappedHandler, len(filterList)-1)
+	hanflerChains := processFilter(filters, wrappedHandler, len(filters)-1)
 
 	if method == GETMETHOD {
-		svrRouter.GET(path, hanflerChains)
+		r.GET(path, hanflerChains)
 	} else {
-		svrRouter.POST(path, hanflerChains)
+		r.POST(path, hanflerChains)
 	}
 }
 
@@ -66,13 +100,13 @@ func AddFilter(filter Filter) {
 	filterList = append(filterList, filter)
 }
 
-func processFilter(h fasthttp.RequestHandler, index int) fasthttp.RequestHandler {
+func processFilter(filters []Filter, h fasthttp.RequestHandler, index int) fasthttp.RequestHandler {
 	if index == -1 {
 		return h
 	}
-	fWrap := filterList[index](h)
+	fWrap := filters[index](h)
 	index--
-	return processFilter(fWrap, index)
+	return processFilter(filters, fWrap, index)
 }
 
 func handlerWrapper(h Handler) fasthttp.RequestHandler {
@@ -119,12 +153,23 @@ func debugLogFilter(h fasthttp.RequestHandler) fasthttp.RequestHandler {
 	}
 }
 
-func byte2str(bytes []byte) string {
-	bytePointer := unsafe.Pointer(&bytes)
-	byteHeader := (*reflect.SliceHeader)(bytePointer)
-	strHeader := reflect.StringHeader{
-		Data: byteHeader.Data,
-		Len:  byteHeader.Len,
+// authFilter rejects the requests without the bearer token.
+func authFilter(token string) Filter {
+	want := []byte("Bearer " + token)
+	return func(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+		return func(ctx *fasthttp.RequestCtx) {
+			auth := ctx.Request.Header.Peek(fasthttp.HeaderAuthorization)
+			if subtle.ConstantTimeCompare(auth, want) != 1 {
+				log.Warnf("admin request unauthorized, remote: %v, req: %s.", ctx.RemoteAddr(), ctx.Request.URI().Path())
+				ctx.WriteString("{\"ret\":1,\"msg\":\"unauthorized\"}")
+				ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+				return
+			}
+			h(ctx)
+		}
 	}
-	return *(*string)(unsafe.Pointer(&strHeader))
+}
+
+func byte2str(bytes []byte) string {
+	return unsafe.String(unsafe.SliceData(bytes), len(bytes))
 }
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/allan-deng/redis-id-generator/internal/generator"
+	"github.com/allan-deng/redis-id-generator/pkg/idgen"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+type AdminRsp struct {
+	Ret    int               `json:"ret"`
+	Msg    string            `json:"msg"`
+	BizTag string            `json:"biztag"`
+	Info   *idgen.BizTagInfo `json:"info,omitempty"`
+}
+
+// BizTagHandler serves the state of a bizTag in the store: /admin/biztag?biztag=x.
+func BizTagHandler(ctx context.Context, req *fasthttp.Request) Response {
+	bizTag := req.URI().QueryArgs().Peek("biztag")
+	if len(bizTag) == 0 {
+		return adminParamErr("biz tag param err")
+	}
+
+	info, err := generator.AdminStore.GetBizTag(ctx, string(bizTag))
+	if err != nil {
+		return adminErr(string(bizTag), "get", err)
+	}
+	return Response{
+		Body: AdminRsp{
+			Ret:    0,
+			Msg:    "succ",
+			BizTag: string(bizTag),
+			Info:   info,
+		},
+	}
+}
+
+// CreateBizTagHandler creates a bizTag: /admin/biztag/create?biztag=x&step=n&start=m.
+// The first id handed out is start+1, start defaults to 0.
+func CreateBizTagHandler(ctx context.Context, req *fasthttp.Request) Response {
+	values := req.URI().QueryArgs()
+	bizTag := values.Peek("biztag")
+	step, errStep := strconv.ParseInt(string(values.Peek("step")), 10, 64)
+	start, errStart := int64(0), error(nil)
+	if values.Has("start") {
+		start, errStart = strconv.ParseInt(string(values.Peek("start")), 10, 64)
+	}
+	if len(bizTag) == 0 || errStep != nil || errStart != nil || step <= 0 || start < 0 {
+		return adminParamErr("biz tag, step or start param err")
+	}
+
+	return adminChange(string(bizTag), "create", false, func() error {
+		return generator.AdminStore.CreateBizTag(ctx, string(bizTag), start, step)
+	})
+}
+
+// SetStepHandler changes the step of a bizTag: /admin/biztag/step?biztag=x&step=n.
+// The ids of the segments in memory are still handed out.
+func SetStepHandler(ctx context.Context, req *fasthttp.Request) Response {
+	values := req.URI().QueryArgs()
+	bizTag := values.Peek("biztag")
+	step, err := strconv.ParseInt(string(values.Peek("step")), 10, 64)
+	if len(bizTag) == 0 || err != nil || step <= 0 {
+		return adminParamErr("biz tag or step param err")
+	}
+
+	return adminChange(string(bizTag), "set step", false, func() error {
+		return generator.AdminStore.SetStep(ctx, string(bizTag), step)
+	})
+}
+
+// DisableBizTagHandler rejects the requests of a bizTag: /admin/biztag/disable?biztag=x.
+func DisableBizTagHandler(ctx context.Context, req *fasthttp.Request) Response {
+	return setDisabled(ctx, req, true)
+}
+
+// EnableBizTagHandler serves a disabled bizTag again: /admin/biztag/enable?biztag=x.
+func EnableBizTagHandler(ctx context.Context, req *fasthttp.Request) Response {
+	return setDisabled(ctx, req, false)
+}
+
+func setDisabled(ctx context.Context, req *fasthttp.Request, disabled bool) Response {
+	bizTag := req.URI().QueryArgs().Peek("biztag")
+	if len(bizTag) == 0 {
+		return adminParamErr("biz tag param err")
+	}
+
+	op := "enable"
+	if disabled {
+		op = "disable"
+	}
+	return adminChange(string(bizTag), op, disabled, func() error {
+		return generator.AdminStore.SetDisabled(ctx, string(bizTag), disabled)
+	})
+}
+
+// ArchiveBizTagHandler retires a bizTag, its state is kept and it cannot be
+// created again: /admin/biztag/archive?biztag=x.
+func ArchiveBizTagHandler(ctx context.Context, req *fasthttp.Request) Response {
+	bizTag := req.URI().QueryArgs().Peek("biztag")
+	if len(bizTag) == 0 {
+		return adminParamErr("biz tag param err")
+	}
+
+	return adminChange(string(bizTag), "archive", true, func() error {
+		return generator.AdminStore.ArchiveBizTag(ctx, string(bizTag))
+	})
+}
+
+// DeleteBizTagHandler removes a bizTag, archived or not: /admin/biztag/delete?biztag=x.
+// A bizTag requested again afterwards starts over and repeats its ids.
+func DeleteBizTagHandler(ctx context.Context, req *fasthttp.Request) Response {
+	bizTag := req.URI().QueryArgs().Peek("biztag")
+	if len(bizTag) == 0 {
+		return adminParamErr("biz tag param err")
+	}
+
+	return adminChange(string(bizTag), "delete", true, func() error {
+		return generator.AdminStore.DeleteBizTag(ctx, string(bizTag))
+	})
+}
+
+// adminChange runs the change op of bizTag. When evict is set, the bizTag is
+// removed from the cache so that this node stops serving the ids it holds,
+// the other nodes stop when they fetch their next segment.
+func adminChange(bizTag string, op string, evict bool, change func() error) Response {
+	if err := change(); err != nil {
+		return adminErr(bizTag, op, err)
+	}
+	if evict {
+		generator.IdGen.RemoveBizTag(bizTag)
+	}
+	log.Infof("admin %v biztag succ, biz tag: %v.", op, bizTag)
+	return Response{
+		Body: AdminRsp{
+			Ret:    0,
+			Msg:    "succ",
+			BizTag: bizTag,
+		},
+	}
+}
+
+func adminErr(bizTag string, op string, err error) Response {
+	log.Errorf("admin %v biztag failed, biz tag: %v, err: %v.", op, bizTag, err)
+	ret, httpStatus := errRet(err)
+	if ret == 2 {
+		httpStatus = fasthttp.StatusInternalServerError
+	}
+	return Response{
+		HttpStatus: httpStatus,
+		Body: AdminRsp{
+			Ret:    ret,
+			Msg:    fmt.Sprintf("%v biztag failed.%v", op, err.Error()),
+			BizTag: bizTag,
+		},
+	}
+}
+
+func adminParamErr(msg string) Response {
+	return Response{
+		HttpStatus: fasthttp.StatusBadRequest,
+		Body: AdminRsp{
+			Ret: 1,
+			Msg: msg,
+		},
+	}
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/allan-deng/redis-id-generator/pkg/idgen"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Ret codes of the failures to allocate ids and to manage bizTags. Other
+// failures are ret 2.
+const (
+	RetStoreUnavailable = 3  // The store failed to provide a segment
+	RetSegmentExhausted = 4  // The ids in memory ran out before the next segment was loaded
+	RetTimeout          = 5  // The request timed out
+	RetFilterOverflow   = 6  // The id is too large for the id filter
+	RetBizTagDisabled   = 7  // The bizTag was disabled by the admin api
+	RetUnknownBizTag    = 8  // The bizTag does not exist
+	RetBizTagExists     = 9  // The bizTag to create exists, or was archived
+	RetBizTagArchived   = 10 // The bizTag was archived by the admin api
+	RetBelowWatermark   = 11 // The store handed out a segment below the high water mark
+	RetClockBackwards   = 12 // The clock of the snowflake generator moved backwards
+	RetLeaseLost        = 13 // The snowflake generator lost the lease of its worker id
+)
+
+// errRet returns the ret code and the http status of a failure to allocate
+// ids or to manage a bizTag. A failure of several kinds is reported by its
+// cause: a request which found the segments exhausted because the store is
+// down is RetStoreUnavailable.
+func errRet(err error) (ret int, httpStatus int) {
+	switch {
+	case errors.Is(err, idgen.ErrBizTagDisabled):
+		return RetBizTagDisabled, fasthttp.StatusForbidden
+	case errors.Is(err, idgen.ErrUnknownBizTag):
+		return RetUnknownBizTag, fasthttp.StatusNotFound
+	case errors.Is(err, idgen.ErrBizTagExists):
+		return RetBizTagExists, fasthttp.StatusConflict
+	case errors.Is(err, idgen.ErrBizTagArchived):
+		return RetBizTagArchived, fasthttp.StatusGone
+	case errors.Is(err, idgen.ErrBelowWatermark):
+		return RetBelowWatermark, fasthttp.StatusServiceUnavailable
+	case errors.Is(err, idgen.ErrClockBackwards):
+		return RetClockBackwards, fasthttp.StatusServiceUnavailable
+	case errors.Is(err, idgen.ErrLeaseLost):
+		return RetLeaseLost, fasthttp.StatusServiceUnavailable
+	case errors.Is(err, idgen.ErrStoreUnavailable):
+		return RetStoreUnavailable, fasthttp.StatusServiceUnavailable
+	case errors.Is(err, idgen.ErrSegmentExhausted):
+		return RetSegmentExhausted, fasthttp.StatusTooManyRequests
+	case errors.Is(err, idgen.ErrTimeout):
+		return RetTimeout, fasthttp.StatusGatewayTimeout
+	case errors.Is(err, idgen.ErrFilterOverflow):
+		return RetFilterOverflow, fasthttp.StatusInternalServerError
+	default:
+		return 2, fasthttp.StatusOK
+	}
+}
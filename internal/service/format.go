@@ -0,0 +1,62 @@
+package service
+
+import (
+	"github.com/allan-deng/redis-id-generator/internal/generator"
+)
+
+// FormatNumber returns ids as JSON numbers. Other formats return ids as
+// strings encoded by the encoder of the format, "string" returns decimal
+// strings, which keeps ids above 2^53 exact in JavaScript.
+const FormatNumber = "number"
+
+// getFormat returns the format of the request, the default format of the
+// bizTag when not given.
+func getFormat(bizTag string, format []byte) string {
+	if len(format) == 0 {
+		return generator.FormatOf(bizTag)
+	}
+	return string(format)
+}
+
+func formatId(format string, id int64) (interface{}, error) {
+	if format == FormatNumber {
+		return id, nil
+	}
+	encoder, err := generator.Encoder(format)
+	if err != nil {
+		return nil, err
+	}
+	return encoder.Encode(id)
+}
+
+func formatIds(format string, ids []int64) (interface{}, error) {
+	if format == FormatNumber {
+		return ids, nil
+	}
+	encoder, err := generator.Encoder(format)
+	if err != nil {
+		return nil, err
+	}
+
+	strs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		str, err := encoder.Encode(id)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, str)
+	}
+	return strs, nil
+}
+
+// parseId parses an id given in the format.
+func parseId(format string, id []byte) (int64, error) {
+	if format == FormatNumber {
+		format = "decimal"
+	}
+	encoder, err := generator.Encoder(format)
+	if err != nil {
+		return 0, err
+	}
+	return encoder.Decode(string(id))
+}
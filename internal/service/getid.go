@@ -3,8 +3,10 @@ package service
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/allan-deng/redis-id-generator/internal/generator"
+	"github.com/allan-deng/redis-id-generator/internal/metrics"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
@@ -16,10 +18,10 @@ type Response struct {
 }
 
 type IdRsp struct {
-	Ret    int    `json:"ret"`
-	Msg    string `json:"msg"`
-	BizTag string `json:"biztag"`
-	Id     int64  `json:"id"`
+	Ret    int         `json:"ret"`
+	Msg    string      `json:"msg"`
+	BizTag string      `json:"biztag"`
+	Id     interface{} `json:"id"` // int64, or string when a string format is requested
 }
 
 func GetIdHandler(ctx context.Context, req *fasthttp.Request) Response {
@@ -35,25 +37,103 @@ func GetIdHandler(ctx context.Context, req *fasthttp.Request) Response {
 		}
 	}
 
-	id, err := generator.IdGen.GetId(ctx, string(bizTag))
+	format := getFormat(string(bizTag), values.Peek("format"))
+	if _, err := formatId(format, 0); err != nil {
+		log.Errorf("format param err, biz tag: %v, format: %v.", string(bizTag), format)
+		return Response{
+			Body: IdRsp{
+				Ret:    1,
+				Msg:    fmt.Sprintf("format param err.%v", err.Error()),
+				BizTag: string(bizTag),
+				Id:     0,
+			},
+		}
+	}
+
+	start := time.Now()
+	id, err := generator.Get(string(bizTag)).GetId(ctx, string(bizTag))
 	if err != nil {
+		metrics.ObserveRequest("id", string(bizTag), 0, time.Since(start))
 		log.Errorf("get id failed, biz tag: %v, err: %v.", bizTag, err)
+		ret, httpStatus := errRet(err)
 		return Response{
+			HttpStatus: httpStatus,
 			Body: IdRsp{
-				Ret:    2,
+				Ret:    ret,
 				Msg:    fmt.Sprintf("get id failed.%v", err.Error()),
 				BizTag: string(bizTag),
 				Id:     id,
 			},
 		}
 	}
+	metrics.ObserveRequest("id", string(bizTag), 1, time.Since(start))
 	log.Debugf("get id succ, biz tag: %v, id: %v.", string(bizTag), id)
+
+	rspId, err := formatId(format, id)
+	if err != nil {
+		log.Errorf("format id failed, biz tag: %v, id: %v, format: %v, err: %v.", string(bizTag), id, format, err)
+		return Response{
+			Body: IdRsp{
+				Ret:    2,
+				Msg:    fmt.Sprintf("format id failed.%v", err.Error()),
+				BizTag: string(bizTag),
+				Id:     0,
+			},
+		}
+	}
 	return Response{
 		Body: IdRsp{
+			Ret:    0,
+			Msg:    "succ",
+			BizTag: string(bizTag),
+			Id:     rspId,
+		},
+	}
+}
+
+type DecodeIdRsp struct {
+	Ret    int    `json:"ret"`
+	Msg    string `json:"msg"`
+	BizTag string `json:"biztag"`
+	Id     int64  `json:"id"`
+	RawId  int64  `json:"raw_id"`
+}
+
+// DecodeIdHandler turns a public id back into the raw segment id: /decode?biztag=x&id=n.
+// The id can be given in a string format with &format=.
+func DecodeIdHandler(ctx context.Context, req *fasthttp.Request) Response {
+	values := req.URI().QueryArgs()
+	bizTag := values.Peek("biztag")
+	id, err := parseId(getFormat(string(bizTag), values.Peek("format")), values.Peek("id"))
+	if bizTag == nil || err != nil {
+		log.Errorf("decode id param err, biz tag: %v, id: %v.", string(bizTag), string(values.Peek("id")))
+		return Response{
+			Body: DecodeIdRsp{
+				Ret: 1,
+				Msg: "biz tag or id param err",
+			},
+		}
+	}
+
+	rawId, err := generator.DecodeId(string(bizTag), id)
+	if err != nil {
+		log.Errorf("decode id failed, biz tag: %v, id: %v, err: %v.", string(bizTag), id, err)
+		return Response{
+			Body: DecodeIdRsp{
+				Ret:    2,
+				Msg:    fmt.Sprintf("decode id failed.%v", err.Error()),
+				BizTag: string(bizTag),
+				Id:     id,
+			},
+		}
+	}
+	return Response{
+		Body: DecodeIdRsp{
 			Ret:    0,
 			Msg:    "succ",
 			BizTag: string(bizTag),
 			Id:     id,
+			RawId:  rawId,
 		},
 	}
 }
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/allan-deng/redis-id-generator/internal/generator"
+	"github.com/allan-deng/redis-id-generator/internal/metrics"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+type IdsRsp struct {
+	Ret    int         `json:"ret"`
+	Msg    string      `json:"msg"`
+	BizTag string      `json:"biztag"`
+	Ids    interface{} `json:"ids,omitempty"` // []int64, or []string when a string format is requested
+	Ranges []IdRange   `json:"ranges,omitempty"`
+}
+
+// IdRange is a run of consecutive ids, both ends included.
+type IdRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// GetIdsHandler allocates a batch of ids: /ids?biztag=x&count=n.
+// With range=1 the ids are returned as consecutive {start,end} ranges instead
+// of a list, which is only available when no id filter is active.
+func GetIdsHandler(ctx context.Context, req *fasthttp.Request) Response {
+	values := req.URI().QueryArgs()
+	bizTag := values.Peek("biztag")
+	if bizTag == nil {
+		log.Errorf("url lack of biztag")
+		return Response{
+			Body: IdsRsp{
+				Ret: 1,
+				Msg: "biz tag param err",
+			},
+		}
+	}
+
+	count, err := values.GetUint("count")
+	if err != nil || count <= 0 || count > generator.MaxBatchCount {
+		log.Errorf("count param err, biz tag: %v, count: %v.", string(bizTag), string(values.Peek("count")))
+		return Response{
+			Body: IdsRsp{
+				Ret:    1,
+				Msg:    fmt.Sprintf("count param err, should be in [1, %d]", generator.MaxBatchCount),
+				BizTag: string(bizTag),
+			},
+		}
+	}
+
+	format := getFormat(string(bizTag), values.Peek("format"))
+	if _, err := formatId(format, 0); err != nil {
+		log.Errorf("format param err, biz tag: %v, format: %v.", string(bizTag), format)
+		return Response{
+			Body: IdsRsp{
+				Ret:    1,
+				Msg:    fmt.Sprintf("format param err.%v", err.Error()),
+				BizTag: string(bizTag),
+			},
+		}
+	}
+
+	useRange := values.GetBool("range")
+	if useRange && format != FormatNumber {
+		return Response{
+			Body: IdsRsp{
+				Ret:    1,
+				Msg:    "range param err, range form is only available in number format",
+				BizTag: string(bizTag),
+			},
+		}
+	}
+	if useRange && generator.HasFilter(string(bizTag)) {
+		return Response{
+			Body: IdsRsp{
+				Ret:    1,
+				Msg:    "range param err, range form is unavailable when id filter is active",
+				BizTag: string(bizTag),
+			},
+		}
+	}
+
+	// On partial failure the ids already allocated are dropped,
+	// ids are not required to be continuous.
+	start := time.Now()
+	ids, err := generator.Get(string(bizTag)).GetIds(ctx, string(bizTag), count)
+	if err != nil {
+		metrics.ObserveRequest("ids", string(bizTag), 0, time.Since(start))
+		log.Errorf("get ids failed, biz tag: %v, count: %v, err: %v.", string(bizTag), count, err)
+		ret, httpStatus := errRet(err)
+		return Response{
+			HttpStatus: httpStatus,
+			Body: IdsRsp{
+				Ret:    ret,
+				Msg:    fmt.Sprintf("get ids failed.%v", err.Error()),
+				BizTag: string(bizTag),
+			},
+		}
+	}
+	metrics.ObserveRequest("ids", string(bizTag), len(ids), time.Since(start))
+	log.Debugf("get ids succ, biz tag: %v, count: %v.", string(bizTag), count)
+
+	rsp := IdsRsp{
+		Ret:    0,
+		Msg:    "succ",
+		BizTag: string(bizTag),
+	}
+	if useRange {
+		rsp.Ranges = toRanges(ids)
+		return Response{
+			Body: rsp,
+		}
+	}
+
+	rsp.Ids, err = formatIds(format, ids)
+	if err != nil {
+		log.Errorf("format ids failed, biz tag: %v, format: %v, err: %v.", string(bizTag), format, err)
+		return Response{
+			Body: IdsRsp{
+				Ret:    2,
+				Msg:    fmt.Sprintf("format ids failed.%v", err.Error()),
+				BizTag: string(bizTag),
+			},
+		}
+	}
+	return Response{
+		Body: rsp,
+	}
+}
+
+// toRanges compacts ordered ids into runs of consecutive ids.
+func toRanges(ids []int64) []IdRange {
+	ranges := make([]IdRange, 0, 1)
+	for _, id := range ids {
+		last := len(ranges) - 1
+		if last >= 0 && ranges[last].End+1 == id {
+			ranges[last].End = id
+			continue
+		}
+		ranges = append(ranges, IdRange{Start: id, End: id})
+	}
+	return ranges
+}
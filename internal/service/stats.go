@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+
+	"github.com/allan-deng/redis-id-generator/internal/generator"
+	"github.com/allan-deng/redis-id-generator/pkg/idgen"
+
+	"github.com/valyala/fasthttp"
+)
+
+type StatsRsp struct {
+	Ret   int                 `json:"ret"`
+	Msg   string              `json:"msg"`
+	Stats []idgen.BizTagStats `json:"stats"`
+}
+
+// StatsHandler serves the state of the id allocators of the cached bizTags:
+// /admin/stats, or /admin/stats?biztag=x for one bizTag.
+func StatsHandler(ctx context.Context, req *fasthttp.Request) Response {
+	bizTag := req.URI().QueryArgs().Peek("biztag")
+	if bizTag == nil {
+		return Response{
+			Body: StatsRsp{
+				Ret:   0,
+				Msg:   "succ",
+				Stats: generator.IdGen.Stats(),
+			},
+		}
+	}
+
+	stats, ok := generator.IdGen.StatsOf(string(bizTag))
+	if !ok {
+		return Response{
+			HttpStatus: fasthttp.StatusNotFound,
+			Body: StatsRsp{
+				Ret: 1,
+				Msg: "biz tag not cached",
+			},
+		}
+	}
+	return Response{
+		Body: StatsRsp{
+			Ret:   0,
+			Msg:   "succ",
+			Stats: []idgen.BizTagStats{stats},
+		},
+	}
+}
@@ -8,11 +8,13 @@ import (
 type bizCache struct {
 	cache      sync.Map
 	expireTime time.Duration // If the expireTime is not 0, the expired cache is periodically cleared
+	observer   Observer      // Receives the evictions
 }
 
-func newBizCache(expireTime time.Duration) *bizCache {
+func newBizCache(expireTime time.Duration, observer Observer) *bizCache {
 	cache := &bizCache{
 		expireTime: expireTime,
+		observer:   observer,
 	}
 
 	if cache.expireTime != 0 {
@@ -42,11 +44,35 @@ func (this *bizCache) clear() {
 
 		this.cache.Range(func(key, value interface{}) bool {
 			alloc := value.(*idAllocator)
-			if next.Sub(alloc.UpdateTime) > this.expireTime {
-				// TODO need record clear operation
-				this.cache.Delete(key)
+			if idle := next.Sub(alloc.lastUpdate()); idle > this.expireTime {
+				this.evict(alloc, idle)
 			}
 			return true
 		})
 	}
 }
+
+// remove evicts bizTag, it reports whether bizTag was cached.
+func (this *bizCache) remove(bizTag string) bool {
+	alloc := this.get(bizTag)
+	if alloc == nil {
+		return false
+	}
+	this.evict(alloc, time.Since(alloc.lastUpdate()))
+	return true
+}
+
+// evict removes alloc from the cache and stops it, idle is the time it was unused.
+func (this *bizCache) evict(alloc *idAllocator, idle time.Duration) {
+	// Deleted only if it is still the cached one.
+	if !this.cache.CompareAndDelete(alloc.Key, alloc) {
+		return
+	}
+	alloc.close()
+
+	alloc.Lock()
+	e := segmentEvent(EventBizTagEvicted, alloc.Key, alloc.current())
+	alloc.Unlock()
+	e.Latency = idle
+	this.observer.Observe(e)
+}
@@ -0,0 +1,180 @@
+package idgen
+
+import "time"
+
+// bizTagConfig is the allocation settings of a bizTag. The settings given by
+// the Options of NewIdGenrator are the defaults, WithBizTagConfig overrides
+// them for one bizTag.
+type bizTagConfig struct {
+	step int64 // When no biztag info is stored, the initialization is done using step
+
+	// Adaptive step. When stepDuration is not 0, the step of the bizTag is
+	// adjusted so that a segment lasts about stepDuration, within [minStep, MaxStep].
+	stepDuration time.Duration
+	minStep      int64
+
+	// A fetch of a segment is bounded by preloadTimeout and retried up to
+	// preloadRetryTimes times, with a backoff from preloadBackoff to
+	// preloadMaxBackoff, see retryPolicy.
+	preloadRetryTimes int
+	preloadTimeout    time.Duration
+	preloadBackoff    time.Duration
+	preloadMaxBackoff time.Duration
+
+	// Filter for Post-processing of 'ID'.
+	// Due to the use of 'ID segmentation', the obtained raw IDs are sequentially incremented,
+	// which may be maliciously exploited for traversal. If there is a need to obfuscate the
+	// IDs, filters can be used.
+	filters []IdFilter
+
+	// Encoder of GetIdString and GetIdsString, it runs after the filters.
+	encoder IdEncoder
+
+	// Allocate ids without taking the allocator lock, see id_alloc_lockfree.go.
+	lockFree bool
+
+	// Number of segments preloaded ahead of the one in use.
+	prefetch int
+
+	// When to preload the next segment, see WithPreloadRatio and WithPreloadTime.
+	preloadRatio float64
+	preloadTime  time.Duration
+}
+
+type BizTagOption func(*bizTagConfig)
+
+// WithBizTagConfig overrides the default settings for bizTag. The settings
+// not given by opts are the defaults, so are all settings of the bizTags
+// without a config.
+func WithBizTagConfig(bizTag string, opts ...BizTagOption) Option {
+	return func(idgen *IdGenerator) {
+		idgen.bizTagOpts[bizTag] = append(idgen.bizTagOpts[bizTag], opts...)
+	}
+}
+
+// WithBizTagStep is WithStep for one bizTag.
+func WithBizTagStep(step int64) BizTagOption {
+	if step > MaxStep {
+		step = MaxStep
+	}
+	if step <= 0 {
+		step = DefaultStep
+	}
+	return func(conf *bizTagConfig) {
+		conf.step = step
+	}
+}
+
+// WithBizTagAdaptiveStep is WithAdaptiveStep for one bizTag.
+// A duration of 0 disables the adaptive step of the bizTag.
+func WithBizTagAdaptiveStep(duration time.Duration, minStep int64) BizTagOption {
+	if duration < 0 {
+		duration = DefaultStepDuration
+	}
+	if minStep > MaxStep {
+		minStep = MaxStep
+	}
+	return func(conf *bizTagConfig) {
+		conf.stepDuration = duration
+		conf.minStep = minStep
+	}
+}
+
+// WithBizTagPreloadRetryTimes is WithPreloadRetryTimes for one bizTag.
+func WithBizTagPreloadRetryTimes(times int) BizTagOption {
+	return func(conf *bizTagConfig) {
+		conf.preloadRetryTimes = times
+	}
+}
+
+// WithBizTagPreloadTimeout is WithPreloadTimeout for one bizTag.
+func WithBizTagPreloadTimeout(timeout time.Duration) BizTagOption {
+	return func(conf *bizTagConfig) {
+		conf.preloadTimeout = timeout
+	}
+}
+
+// WithBizTagPreloadBackoff is WithPreloadBackoff for one bizTag.
+func WithBizTagPreloadBackoff(backoff time.Duration, maxBackoff time.Duration) BizTagOption {
+	backoff, maxBackoff = preloadBackoff(backoff, maxBackoff)
+	return func(conf *bizTagConfig) {
+		conf.preloadBackoff = backoff
+		conf.preloadMaxBackoff = maxBackoff
+	}
+}
+
+// WithBizTagIdFilter replaces the default filters of the bizTag, an empty
+// filters turns the filters off.
+func WithBizTagIdFilter(filters []IdFilter) BizTagOption {
+	return func(conf *bizTagConfig) {
+		conf.filters = append([]IdFilter(nil), filters...)
+	}
+}
+
+// WithBizTagIdEncoder is WithIdEncoder for one bizTag.
+func WithBizTagIdEncoder(encoder IdEncoder) BizTagOption {
+	return func(conf *bizTagConfig) {
+		conf.encoder = encoder
+	}
+}
+
+// WithBizTagLockFree is WithLockFree for one bizTag.
+func WithBizTagLockFree(lockFree bool) BizTagOption {
+	return func(conf *bizTagConfig) {
+		conf.lockFree = lockFree
+	}
+}
+
+// WithBizTagPrefetch is WithPrefetch for one bizTag.
+func WithBizTagPrefetch(n int) BizTagOption {
+	if n < 1 {
+		n = DefaultPrefetch
+	}
+	return func(conf *bizTagConfig) {
+		conf.prefetch = n
+	}
+}
+
+// WithBizTagPreloadRatio is WithPreloadRatio for one bizTag.
+func WithBizTagPreloadRatio(ratio float64) BizTagOption {
+	if ratio <= 0 || ratio > 1 {
+		ratio = DefaultPreloadRatio
+	}
+	return func(conf *bizTagConfig) {
+		conf.preloadRatio = ratio
+	}
+}
+
+// WithBizTagPreloadTime is WithPreloadTime for one bizTag, a d of 0 goes back
+// to the preload ratio.
+func WithBizTagPreloadTime(d time.Duration) BizTagOption {
+	if d < 0 {
+		d = 0
+	}
+	return func(conf *bizTagConfig) {
+		conf.preloadTime = d
+	}
+}
+
+// retryPolicy returns how the segments of the bizTag are fetched.
+func (this *bizTagConfig) retryPolicy() retryPolicy {
+	return retryPolicy{
+		retries:    this.preloadRetryTimes,
+		timeout:    this.preloadTimeout,
+		backoff:    this.preloadBackoff,
+		maxBackoff: this.preloadMaxBackoff,
+	}
+}
+
+// newBizTagConfig applies opts on a copy of the defaults.
+func newBizTagConfig(defaults bizTagConfig, opts []BizTagOption) *bizTagConfig {
+	conf := defaults
+	conf.filters = append([]IdFilter(nil), defaults.filters...)
+	for _, o := range opts {
+		o(&conf)
+	}
+	if conf.minStep <= 0 {
+		conf.minStep = conf.step
+	}
+	return &conf
+}
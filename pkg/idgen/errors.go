@@ -0,0 +1,97 @@
+package idgen
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of failures of IdGenerator, test them with errors.Is. An error
+// may be of several kinds, e.g. a request which waited for a segment the
+// store failed to provide is ErrSegmentExhausted, ErrTimeout and
+// ErrStoreUnavailable.
+var (
+	// ErrStoreUnavailable is a failed fetch of a segment from the store,
+	// the error is a *StoreError.
+	ErrStoreUnavailable = errors.New("id store unavailable")
+	// ErrSegmentExhausted is a request that found the segments in memory
+	// used up and could not wait for the next one.
+	ErrSegmentExhausted = errors.New("id segment exhausted")
+	// ErrFilterOverflow is an id too large for a filter to transform.
+	ErrFilterOverflow = errors.New("id filter overflow")
+	// ErrTimeout is a request whose context was done before it was served,
+	// the error of the context is wrapped too.
+	ErrTimeout = errors.New("timeout")
+	// ErrBelowWatermark is a segment from the store with ids not above the
+	// high water mark of its bizTag, see WithWatermark.
+	ErrBelowWatermark = errors.New("id segment below high water mark")
+	// ErrInvalidCount is a batch of ids whose count is not in
+	// [1, MaxIdCount].
+	ErrInvalidCount = errors.New("invalid id count")
+)
+
+// The failures of the bizTags managed through an AdminStore. The store
+// refuses the segments of a disabled or archived bizTag, and of an unknown
+// one in strict mode (see WithStrictBizTags), which is not retried and not
+// an ErrStoreUnavailable.
+var (
+	ErrUnknownBizTag  = errors.New("unknown biztag")
+	ErrBizTagExists   = errors.New("biztag already exists")
+	ErrBizTagDisabled = errors.New("biztag disabled")
+	ErrBizTagArchived = errors.New("biztag archived")
+)
+
+// refused reports whether err is the store refusing the bizTag, or a segment
+// refused below the high water mark. Retrying will not help.
+func refused(err error) bool {
+	return errors.Is(err, ErrUnknownBizTag) || errors.Is(err, ErrBizTagDisabled) || errors.Is(err, ErrBizTagArchived) ||
+		errors.Is(err, ErrBelowWatermark)
+}
+
+// ErrWaitTimeout is returned when the context of a request is done before
+// the segment it waits for is loaded. The error of the context is wrapped
+// too, and so is the *StoreError of the last preload when it failed.
+var ErrWaitTimeout = fmt.Errorf("%w, wait for next seg %w", ErrSegmentExhausted, ErrTimeout)
+
+// StoreError is a failed fetch of a segment of BizTag, Err is the error of
+// the last attempt.
+type StoreError struct {
+	BizTag string
+	Err    error
+}
+
+func (this *StoreError) Error() string {
+	return fmt.Sprintf("[%s]%v: %v", this.BizTag, ErrStoreUnavailable, this.Err)
+}
+
+func (this *StoreError) Unwrap() error {
+	return this.Err
+}
+
+func (this *StoreError) Is(target error) bool {
+	return target == ErrStoreUnavailable
+}
+
+// storeError returns the error of a failed fetch of a segment of bizTag, the
+// store refusing the bizTag is returned as is.
+func storeError(bizTag string, err error) error {
+	if refused(err) {
+		return err
+	}
+	return &StoreError{BizTag: bizTag, Err: err}
+}
+
+// FilterError is a failure of the id filter Filter on the raw id Id.
+type FilterError struct {
+	BizTag string
+	Filter string // Function name of the filter
+	Id     int64
+	Err    error
+}
+
+func (this *FilterError) Error() string {
+	return fmt.Sprintf("[%s]id filter failed. func[%s], id[%d]: %v", this.BizTag, this.Filter, this.Id, this.Err)
+}
+
+func (this *FilterError) Unwrap() error {
+	return this.Err
+}
@@ -0,0 +1,122 @@
+package idgen
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// storeErrDemo always fails
+type storeErrDemo struct {
+	err error
+}
+
+func (s *storeErrDemo) GetNextSegment(ctx context.Context, bizTag string, step int64) (*Seg, error) {
+	return nil, s.err
+}
+
+func TestErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	errRedis := errors.New("redis down")
+	backoff := WithPreloadBackoff(time.Millisecond, time.Millisecond)
+
+	tests := []struct {
+		name    string
+		getErr  func() error
+		wantIs  []error
+		wantNot []error
+	}{
+		{
+			name: "test. store unavailable at init",
+			getErr: func() error {
+				idGen := NewIdGenrator(&storeErrDemo{err: errRedis}, backoff)
+				_, err := idGen.GetId(context.Background(), "test")
+				return err
+			},
+			wantIs:  []error{ErrStoreUnavailable, errRedis},
+			wantNot: []error{ErrSegmentExhausted, ErrTimeout, ErrFilterOverflow},
+		},
+		{
+			name: "test. segment exhausted, store unavailable",
+			getErr: func() error {
+				idGen := NewIdGenrator(&storeFlakyDemo{fails: 1000}, backoff, WithStep(3), WithWaitTimeout(50*time.Millisecond))
+				idGen.GetId(context.Background(), "test")
+				_, err := idGen.GetId(context.Background(), "test")
+				return err
+			},
+			wantIs:  []error{ErrSegmentExhausted, ErrTimeout, ErrWaitTimeout, context.DeadlineExceeded, ErrStoreUnavailable},
+			wantNot: []error{ErrFilterOverflow},
+		},
+		{
+			name: "test. segment exhausted, store slow",
+			getErr: func() error {
+				idGen := NewIdGenrator(&storeSlowDemo{delay: 200 * time.Millisecond}, WithStep(3), WithWaitTimeout(50*time.Millisecond))
+				idGen.GetId(context.Background(), "test")
+				_, err := idGen.GetId(context.Background(), "test")
+				return err
+			},
+			wantIs:  []error{ErrSegmentExhausted, ErrTimeout, context.DeadlineExceeded},
+			wantNot: []error{ErrStoreUnavailable, ErrFilterOverflow},
+		},
+		{
+			name: "test. timeout at init",
+			getErr: func() error {
+				idGen := NewIdGenrator(&storeSlowDemo{delay: 200 * time.Millisecond})
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				defer cancel()
+				_, err := idGen.GetId(ctx, "test")
+				return err
+			},
+			wantIs:  []error{ErrTimeout, context.DeadlineExceeded},
+			wantNot: []error{ErrStoreUnavailable, ErrSegmentExhausted, ErrFilterOverflow},
+		},
+		{
+			name: "test. filter overflow",
+			getErr: func() error {
+				idGen := NewIdGenrator(&storeDemo{}, WithIdFilter([]IdFilter{AddRandomFilter(63)}))
+				_, err := idGen.GetId(context.Background(), "test")
+				return err
+			},
+			wantIs:  []error{ErrFilterOverflow},
+			wantNot: []error{ErrStoreUnavailable, ErrSegmentExhausted, ErrTimeout},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.getErr()
+			assert.NotNil(err, "should fail")
+			for _, target := range tt.wantIs {
+				assert.ErrorIs(err, target)
+			}
+			for _, target := range tt.wantNot {
+				assert.NotErrorIs(err, target)
+			}
+		})
+	}
+}
+
+func TestErrorsAs(t *testing.T) {
+	assert := assert.New(t)
+
+	errRedis := errors.New("redis down")
+	idGen := NewIdGenrator(&storeErrDemo{err: errRedis}, WithPreloadBackoff(time.Millisecond, time.Millisecond))
+	_, err := idGen.GetId(context.Background(), "test")
+	var storeErr *StoreError
+	if assert.ErrorAs(err, &storeErr) {
+		assert.Equal("test", storeErr.BizTag)
+		assert.Equal(errRedis, storeErr.Err)
+	}
+
+	idGen = NewIdGenrator(&storeDemo{}, WithIdFilter([]IdFilter{AddRandomFilter(63)}))
+	_, err = idGen.GetId(context.Background(), "test")
+	var filterErr *FilterError
+	if assert.ErrorAs(err, &filterErr) {
+		assert.Equal("test", filterErr.BizTag)
+		assert.Equal(int64(1), filterErr.Id)
+		assert.Contains(filterErr.Filter, "AddRandomFilter")
+	}
+}
@@ -1,37 +1,72 @@
 package idgen
 
 import (
+	"context"
 	"fmt"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type preloadFunc func(bizTag string) (*Seg, error)
+// preloadFunc fetches the next segment of bizTag, it gives up when ctx is done.
+type preloadFunc func(ctx context.Context, bizTag string) (*Seg, error)
 
 type idAllocator struct {
 	Key          string       // 'bizTag' is used to distinguish businesses
 	Step         int64        // step
-	currentPos   int64        // The segment buffer index currently in use; There are two buffer buffers in total, which are recycled
-	Buffer       []*idSegment // Two buffers ,One serves as a precache
-	UpdateTime   time.Time    // Record the update time to clear the memory when it has not been used for a long time
+	StepTime     time.Time    // Time the last segment was fetched, used to adapt the step
+	currentPos   int64        // The segment buffer index currently in use; The buffers are recycled as a ring
+	Buffer       []*idSegment // prefetch + 1 buffers, the ones after currentPos serve as a precache
+	prefetch     int          // Number of segments kept preloaded, set before Init
+	updateTime   atomic.Int64 // Record the update time (unix nano) to clear the memory when it has not been used for a long time
 	mutex        sync.Mutex
 	IsPreload    bool // it is being preloaded
 	preloadMutex sync.Mutex
 	IsInit       bool
 	Waiting      []chan byte
+	waitTimeout  time.Duration // Time a request waits for the next segment when its context has no deadline, 0 means no limit
+	refill       bool          // The preload is fetching another segment in a row, the step is kept. Only used by the preload goroutine
+	preloadRatio float64       // The next segment is preloaded when the share of ids left in the current one drops below it
+	preloadTime  time.Duration // When not 0, the next segment is preloaded when the ids left are expected to run out within it
+	load         preloadFunc   // Fetches the next segment for the preload, set before Init
+	preloadErr   error         // Error of the last preload, nil when it succeeded. Guarded by the lock
+	refusedUntil atomic.Int64  // Unix nano until which no preload is started, after the store refused the bizTag
+	refuseDelay  time.Duration // Time no preload is started after the store refused the bizTag, set before Init
+	backoff      retryPolicy   // Backoff between the failed preloads, set before Init
+	failures     int           // Preloads failed in a row. Guarded by the lock
+	backoffUntil atomic.Int64  // Unix nano until which the next preload waits, after failed preloads
+	observer     Observer      // Receives the events of the allocator, set before Init
+
+	// Lifetime of the allocator, the preload stops when it is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Lock free mode, set before Init, see id_alloc_lockfree.go.
+	lockFree   bool
+	queue      atomic.Pointer[segQueue]
+	preloading atomic.Bool
+	loaded     atomic.Pointer[chan struct{}] // Closed and replaced when a preload ends
+	waiters    atomic.Int64                  // Requests waiting for a preload
 }
 
 func NewidAllocator(bizTag string) *idAllocator {
 	idAlloc := &idAllocator{
-		Key:        bizTag,
-		Step:       0,
-		currentPos: 0,
-		Buffer:     make([]*idSegment, 2),
-		UpdateTime: time.Now(),
-		IsPreload:  false,
-		IsInit:     false,
-		Waiting:    make([]chan byte, 0),
+		Key:          bizTag,
+		Step:         0,
+		currentPos:   0,
+		Buffer:       make([]*idSegment, DefaultPrefetch+1),
+		prefetch:     DefaultPrefetch,
+		preloadRatio: DefaultPreloadRatio,
+		refuseDelay:  DefaultPreloadMaxBackoff,
+		backoff:      retryPolicy{retries: DefaultRetry, backoff: DefaultPreloadBackoff, maxBackoff: DefaultPreloadMaxBackoff},
+		observer:     observers(nil),
+		IsPreload:    false,
+		IsInit:       false,
+		Waiting:      make([]chan byte, 0),
 	}
+	idAlloc.ctx, idAlloc.cancel = context.WithCancel(context.Background())
+	idAlloc.update()
 	return idAlloc
 }
 
@@ -42,154 +77,407 @@ func (this *idAllocator) Init(seg *Seg) {
 		return
 	}
 
-	this.Buffer[0] = newIdSegment(0, 0)
-	this.Buffer[1] = newIdSegment(0, 0)
+	if this.prefetch < 1 {
+		this.prefetch = DefaultPrefetch
+	}
+	this.Buffer = make([]*idSegment, this.prefetch+1)
+	for i := range this.Buffer {
+		this.Buffer[i] = newIdSegment(0, 0)
+	}
 
 	this.Step = seg.Step
+	this.StepTime = time.Now()
 	curSeg := this.getSegment()
 	curSeg.init(seg)
 
+	if this.lockFree {
+		this.initLockFree(curSeg)
+	}
+
 	this.IsInit = true
 }
 
-func (this *idAllocator) NextId(f preloadFunc) (int64, error) {
+// NextId allocates an id. When the current segment is used up it waits for
+// the preload of the next one until ctx is done.
+func (this *idAllocator) NextId(ctx context.Context) (int64, error) {
+	if this.lockFree {
+		return this.nextIdLockFree(ctx)
+	}
+
 	this.Lock()
 	defer this.Unlock()
 
-	seg := this.getSegment()
-	if !seg.isInit {
-		panic(fmt.Sprintf("The [%s] id segment is not initialized", this.Key))
-	}
+	var cancel context.CancelFunc
+	var waitStart time.Time
+	for {
+		seg := this.getSegment()
+		if !seg.isInit {
+			panic(fmt.Sprintf("The [%s] id segment is not initialized", this.Key))
+		}
 
-	// get id
-	id := seg.getNext()
-	this.update()
+		// get id
+		id := seg.getNext()
+		this.update()
 
-	// check preload
-	if !this.nextSegInited() && seg.needPreLoad() {
-		this.preload(f)
-	}
+		// check preload
+		if !this.prefetched() && this.needPreLoad(seg) {
+			this.preload()
+		}
 
-	if seg.full() && this.nextSegInited() {
-		this.switchSeg()
-	}
+		if id != 0 {
+			if seg.full() && this.nextSegInited() {
+				this.switchSeg()
+			}
+			return id, nil
+		}
 
-	if id != 0 {
-		return id, nil
-	}
+		// The current 'seg' is used up, take the id from the next one.
+		if this.nextSegInited() {
+			this.switchSeg()
+			continue
+		}
 
-	// wait preload..
-	// Failure to obtain 'id', usually the current cache 'seg' has been used up,
-	// and the next 'seg' has not been initialized.this time should be in preload.
-	// Wait for the preload to complete.
+		// wait preload..
+		// The next 'seg' has not been loaded yet, it should be in preload.
+		// Wait for the preload to complete, then try again. Under a request
+		// peak, the waiting requests may use up the new 'seg' before this one
+		// gets its turn, it then waits for the next preload, until ctx is done.
+		// A failed preload also wakes up the waiters, the first of them to
+		// find the 'seg' used up starts another preload.
+
+		// The store refused the bizTag, no preload is coming until the
+		// refusal delay passes, so fail at once rather than wait for it.
+		if err := this.refusedError(); err != nil {
+			return 0, err
+		}
 
-	waitChan := make(chan byte, 1)
-	this.Waiting = append(this.Waiting, waitChan)
-	this.Unlock() // Other requests enter a timed wait
-	// Attention：
-	// When the step configuration is inappropriate (for example, if the step
-	// configuration is too small, the 'seg' is frequently pulled), there may be
-	// a large number of requests waiting for the next 'seg'.
-	// At this point, if the concurrency is high or the pull seg operation is slow,
-	// there may be a large number of requests waiting.
-	// Some requests may not get an id because the next seq has not been obtained
-	// after waiting for a timeout
+		if cancel == nil {
+			ctx, cancel = this.waitContext(ctx)
+			defer cancel()
+			waitStart = time.Now()
+		}
 
-	// Wait up to 1000ms
-	// The failure is returned promptly and the caller tries again.
-	timer := time.NewTimer(2000 * time.Millisecond)
-	select {
-	case <-waitChan:
-	case <-timer.C:
+		waitChan := make(chan byte, 1)
+		this.Waiting = append(this.Waiting, waitChan)
+		this.Unlock() // Other requests enter a wait
+
+		select {
+		case <-waitChan:
+		case <-ctx.Done():
+		}
+
+		this.Lock()
+		this.unwait(waitChan)
+
+		if ctx.Err() != nil && !this.nextSegInited() {
+			return 0, this.waitError(ctx, waitStart)
+		}
+	}
+}
+
+// NextIds allocates n ids, taking as many as possible from the current
+// segment at a time and moving on to the next segment when it is used up.
+// On failure the ids allocated so far are returned along with the error.
+func (this *idAllocator) NextIds(ctx context.Context, n int64) ([]int64, error) {
+	if this.lockFree {
+		return this.nextIdsLockFree(ctx, n)
 	}
 
 	this.Lock()
+	defer this.Unlock()
 
-	// Check whether the next 'seg' initialization is complete.
-	// When finished, need to switch 'seg'.
+	var cancel context.CancelFunc
+	var waitStart time.Time
+	var ids []int64
+	for int64(len(ids)) < n {
+		seg := this.getSegment()
+		if !seg.isInit {
+			panic(fmt.Sprintf("The [%s] id segment is not initialized", this.Key))
+		}
 
-	if !this.nextSegInited() {
-		return 0, fmt.Errorf("[%s]next seg not initialized", this.Key)
-	}
+		start, count := seg.getRange(n - int64(len(ids)))
+		ids = slices.Grow(ids, int(count))
+		for i := int64(0); i < count; i++ {
+			ids = append(ids, start+i)
+		}
+		this.update()
 
-	this.switchSeg()
-	seg = this.getSegment()
+		// check preload
+		if !this.prefetched() && this.needPreLoad(seg) {
+			this.preload()
+		}
 
-	// FIXME When a request peak is encountered, the number of requests in the waiting state exceeds 'step'.
-	// After switching 'seg', there may not be able to assign an 'id' after switching 'seg'.
-	// An error is returned and the caller tries again.
+		if !seg.full() {
+			continue
+		}
 
-	id = seg.getNext()
-	this.update()
+		if this.nextSegInited() {
+			this.switchSeg()
+			continue
+		}
 
-	if seg.full() {
-		return 0, fmt.Errorf("[%s]seg full", this.Key)
-	}
+		// The current 'seg' is used up and the next one is being preloaded.
+		// Wait for the preload to complete like NextId does.
+		if err := this.refusedError(); err != nil {
+			return ids, err
+		}
+		if cancel == nil {
+			ctx, cancel = this.waitContext(ctx)
+			defer cancel()
+			waitStart = time.Now()
+		}
+
+		waitChan := make(chan byte, 1)
+		this.Waiting = append(this.Waiting, waitChan)
+		this.Unlock()
+
+		select {
+		case <-waitChan:
+		case <-ctx.Done():
+		}
 
-	if id == 0 {
-		return 0, fmt.Errorf("[%s]allocate id fail", this.Key)
+		this.Lock()
+		this.unwait(waitChan)
+
+		if ctx.Err() != nil && this.getSegment().full() && !this.nextSegInited() {
+			return ids, this.waitError(ctx, waitStart)
+		}
 	}
 
-	return id, nil
+	return ids, nil
 }
 
-func (this *idAllocator) preload(f preloadFunc) {
-	if this.IsPreload {
+func (this *idAllocator) preload() {
+	// A closed allocator is no longer in the cache, its requests wait until
+	// their context is done.
+	if this.IsPreload || this.closed() || this.refusing() {
 		return
 	}
 
+	// Mark before starting the goroutine, so that requests arriving before
+	// it runs do not start another preload.
+	this.IsPreload = true
+
 	go func() {
 		// Only one goroutine is preloading at a time
 		this.preloadLock()
 		defer this.preloadUnLock()
+		this.waitBackoff()
+
+		// Fetch segments until all the buffers after the current one are filled.
+		for i := 0; ; i++ {
+			this.refill = i > 0
+			start := time.Now()
+			segConf, err := this.load(this.ctx, this.Key)
+			ok := err == nil && segConf != nil
+			this.observeLoad(segConf, err, time.Since(start))
+
+			this.Lock()
+			if ok {
+				this.Step = segConf.Step
+				this.StepTime = time.Now()
+
+				// Only the preload fills the buffers, the first empty one
+				// after the current 'seg' is where the next 'seg' goes.
+				if seg := this.getFillSegment(); seg != nil {
+					seg.init(segConf)
+				}
+			}
+			this.setPreloadErr(err)
+			done := !ok || this.prefetched()
+
+			// Clear the flag before waking up the waiters, so that a waiter which
+			// finds the new 'seg' drained, or the preload failed, can start the
+			// next preload.
+			if done {
+				this.IsPreload = false
+			}
+			this.wakeup()
+			this.Unlock()
 
-		if this.IsPreload {
-			return
+			if done {
+				return
+			}
 		}
+	}()
+}
 
-		this.IsPreload = true
-		nextPos := this.getNextPos()
+// setPreloadErr records err of the last preload, the caller must hold the
+// lock. When the store refused the bizTag, no preload is started for
+// refuseDelay, so that the requests do not hammer the store with fetches
+// bound to fail. A bizTag enabled again is served once the delay passes.
+// After another failure the next preload waits for a backoff, which keeps
+// doubling from the retries of the failed preloads until one succeeds.
+func (this *idAllocator) setPreloadErr(err error) {
+	this.preloadErr = err
+	if refused(err) {
+		this.refusedUntil.Store(time.Now().Add(this.refuseDelay).UnixNano())
+	} else {
+		this.refusedUntil.Store(0)
+	}
 
-		segConf, err := f(this.Key)
-		if err != nil {
-			// TODO need record preload err
-			return
-		}
+	if err == nil || refused(err) {
+		this.failures = 0
+		this.backoffUntil.Store(0)
+		return
+	}
+	this.failures++
+	delay := this.backoff.delay(this.failures * (this.backoff.retries + 1))
+	this.backoffUntil.Store(time.Now().Add(delay).UnixNano())
+}
 
-		if segConf == nil {
-			return
-		}
+// waitBackoff waits until the backoff after the failed preloads ends, or the
+// allocator is closed. It is called by the preload before fetching.
+func (this *idAllocator) waitBackoff() {
+	d := time.Until(time.Unix(0, this.backoffUntil.Load()))
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-this.ctx.Done():
+	}
+}
 
-		nowNextPos := this.getNextPos()
+// refusing reports whether the store refused the bizTag less than
+// refuseDelay ago.
+func (this *idAllocator) refusing() bool {
+	until := this.refusedUntil.Load()
+	return until != 0 && time.Now().UnixNano() < until
+}
 
-		// The next 'seg' can be initialized only if
-		// the 'seg switch' does not appear during preload.
-		if nextPos == nowNextPos {
-			this.getNextSegment().init(segConf)
-			this.wakeup()
-		}
+// refusedError returns the error of a request which found the segments used
+// up when the last preload was refused by the store and no other preload is
+// running, nil otherwise. The caller must hold the lock.
+func (this *idAllocator) refusedError() error {
+	if this.IsPreload || this.preloading.Load() || !refused(this.preloadErr) {
+		return nil
+	}
+	return fmt.Errorf("[%s]%w: %w", this.Key, ErrSegmentExhausted, this.preloadErr)
+}
 
-		this.IsPreload = false
-	}()
+// waitError is the error of a request whose ctx is done while waiting for
+// the next segment since start, the caller must hold the lock.
+func (this *idAllocator) waitError(ctx context.Context, start time.Time) error {
+	var err error
+	if this.preloadErr != nil {
+		err = fmt.Errorf("[%s]%w: %w: %w", this.Key, ErrWaitTimeout, ctx.Err(), this.preloadErr)
+	} else {
+		err = fmt.Errorf("[%s]%w: %w", this.Key, ErrWaitTimeout, ctx.Err())
+	}
+
+	e := segmentEvent(EventWaitTimeout, this.Key, this.current())
+	e.Latency = time.Since(start)
+	e.Err = err
+	this.observer.Observe(e)
+	return err
 }
 
+// nextStep returns the step of the next segment, Leaf style. The step is
+// doubled when the last segment was used up within duration, and halved when
+// it lasted more than twice the duration.
+// Segments fetched in a row to fill the buffers keep the step.
+func (this *idAllocator) nextStep(duration time.Duration, minStep int64, maxStep int64) int64 {
+	step := this.Step
+	if this.refill {
+		return step
+	}
+	elapsed := time.Since(this.StepTime)
+
+	if elapsed < duration {
+		step *= 2
+	} else if elapsed >= 2*duration {
+		step /= 2
+	}
+
+	if step > maxStep {
+		step = maxStep
+	}
+	if step < minStep {
+		step = minStep
+	}
+	return step
+}
+
+// wakeup wakes up all requests waiting for the next 'seg', the caller must hold the lock.
 func (this *idAllocator) wakeup() {
-	this.Lock()
-	defer this.Unlock()
 	for _, waitChan := range this.Waiting {
 		close(waitChan)
 	}
 	this.Waiting = this.Waiting[:0]
 }
 
+// unwait removes waitChan of a request that stopped waiting before it was
+// woken up, the caller must hold the lock.
+func (this *idAllocator) unwait(waitChan chan byte) {
+	for i, c := range this.Waiting {
+		if c == waitChan {
+			this.Waiting = append(this.Waiting[:i], this.Waiting[i+1:]...)
+			return
+		}
+	}
+}
+
 func (this *idAllocator) getNextPos() int64 {
-	return (^this.currentPos) & 1
+	return (this.currentPos + 1) % int64(len(this.Buffer))
 }
 
 func (this *idAllocator) switchSeg() {
 	seg := this.getSegment()
+	latency := seg.sinceServe()
 	seg.clear()
 	this.currentPos = this.getNextPos()
+	next := this.getSegment()
+	next.serve()
+
+	e := segmentEvent(EventSegmentSwitched, this.Key, next)
+	e.Latency = latency
+	this.observer.Observe(e)
+}
+
+// observeLoad reports a fetch of a segment that took latency. A fetch which
+// ends after the allocator is closed is not reported, the close cancels it.
+func (this *idAllocator) observeLoad(seg *Seg, err error, latency time.Duration) {
+	if this.closed() {
+		return
+	}
+	if err == nil && seg != nil {
+		this.observer.Observe(Event{
+			Type:    EventSegmentFetched,
+			BizTag:  this.Key,
+			MinId:   seg.MaxId - seg.Step,
+			MaxId:   seg.MaxId,
+			Latency: latency,
+		})
+		return
+	}
+	this.observer.Observe(Event{Type: EventPreloadFailed, BizTag: this.Key, Latency: latency, Err: err})
+}
+
+// current returns the segment in use, the caller must hold the lock.
+func (this *idAllocator) current() *idSegment {
+	if this.lockFree {
+		return this.queue.Load().cur
+	}
+	return this.getSegment()
+}
+
+// needPreLoad reports whether the preload of the next segment should start
+// while seg is in use, see idSegment.needPreLoad.
+func (this *idAllocator) needPreLoad(seg *idSegment) bool {
+	return seg.needPreLoad(this.preloadRatio, this.preloadTime)
+}
+
+// close stops the preload of the allocator, it is called when the allocator
+// is removed from the cache.
+func (this *idAllocator) close() {
+	this.cancel()
+}
+
+func (this *idAllocator) closed() bool {
+	return this.ctx.Err() != nil
 }
 
 func (this *idAllocator) Lock() {
@@ -209,7 +497,21 @@ func (this *idAllocator) preloadUnLock() {
 }
 
 func (this *idAllocator) update() {
-	this.UpdateTime = time.Now()
+	this.updateTime.Store(time.Now().UnixNano())
+}
+
+// lastUpdate returns the time the allocator was last used.
+func (this *idAllocator) lastUpdate() time.Time {
+	return time.Unix(0, this.updateTime.Load())
+}
+
+// waitContext bounds ctx by waitTimeout when it has no deadline. It is only
+// called when a request has to wait, so that the fast path does not pay for it.
+func (this *idAllocator) waitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || this.waitTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, this.waitTimeout)
 }
 
 func (this *idAllocator) getSegment() *idSegment {
@@ -223,3 +525,20 @@ func (this *idAllocator) getNextSegment() *idSegment {
 func (this *idAllocator) nextSegInited() bool {
 	return this.Buffer[this.getNextPos()].isInit
 }
+
+// getFillSegment returns the first empty buffer after the current one, nil
+// when all of them are filled.
+func (this *idAllocator) getFillSegment() *idSegment {
+	n := int64(len(this.Buffer))
+	for i := int64(1); i < n; i++ {
+		if seg := this.Buffer[(this.currentPos+i)%n]; !seg.isInit {
+			return seg
+		}
+	}
+	return nil
+}
+
+// prefetched reports whether all the buffers after the current one are filled.
+func (this *idAllocator) prefetched() bool {
+	return this.getFillSegment() == nil
+}
@@ -0,0 +1,225 @@
+package idgen
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// Lock free mode of idAllocator.
+//
+// Ids are taken from the current segment with atomics only. The segments are
+// never reused: the current segment and the preloaded ones are kept in an
+// immutable segQueue, and switching to the next segment or adding a preloaded
+// one swaps the pointer to a new queue with a CAS. Since a used up segment is
+// never put back, the CAS cannot succeed on a stale queue, and each id is
+// handed out once by the atomic add of its segment.
+//
+// Requests that find all segments used up wait on the loaded channel, which
+// is closed and replaced every time a preload ends.
+
+// segQueue is the state of a lock free allocator, it is never modified.
+type segQueue struct {
+	cur  *idSegment
+	next []*idSegment // The preloaded segments, at most prefetch of them
+}
+
+func (this *idAllocator) initLockFree(seg *idSegment) {
+	loaded := make(chan struct{})
+	this.queue.Store(&segQueue{cur: seg})
+	this.loaded.Store(&loaded)
+}
+
+func (this *idAllocator) nextIdLockFree(ctx context.Context) (int64, error) {
+	var cancel context.CancelFunc
+	var waitStart time.Time
+	for {
+		queue := this.queue.Load()
+		id := queue.cur.getNext()
+		if id != 0 {
+			this.update()
+			if len(queue.next) < this.prefetch && this.needPreLoad(queue.cur) {
+				this.preloadLockFree()
+			}
+			return id, nil
+		}
+
+		if len(queue.next) > 0 {
+			if this.queue.CompareAndSwap(queue, &segQueue{cur: queue.next[0], next: queue.next[1:]}) {
+				this.switchedLockFree(queue)
+			}
+			continue
+		}
+
+		if cancel == nil {
+			ctx, cancel = this.waitContext(ctx)
+			defer cancel()
+			waitStart = time.Now()
+		}
+		if err := this.waitLockFree(ctx, queue, waitStart); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// nextIdsLockFree allocates n ids like NextIds.
+func (this *idAllocator) nextIdsLockFree(ctx context.Context, n int64) ([]int64, error) {
+	var cancel context.CancelFunc
+	var waitStart time.Time
+	var ids []int64
+	for int64(len(ids)) < n {
+		queue := this.queue.Load()
+		start, count := queue.cur.getRange(n - int64(len(ids)))
+		ids = slices.Grow(ids, int(count))
+		for i := int64(0); i < count; i++ {
+			ids = append(ids, start+i)
+		}
+
+		if count > 0 {
+			this.update()
+			if len(queue.next) < this.prefetch && this.needPreLoad(queue.cur) {
+				this.preloadLockFree()
+			}
+			continue
+		}
+
+		if len(queue.next) > 0 {
+			if this.queue.CompareAndSwap(queue, &segQueue{cur: queue.next[0], next: queue.next[1:]}) {
+				this.switchedLockFree(queue)
+			}
+			continue
+		}
+
+		if cancel == nil {
+			ctx, cancel = this.waitContext(ctx)
+			defer cancel()
+			waitStart = time.Now()
+		}
+		if err := this.waitLockFree(ctx, queue, waitStart); err != nil {
+			return ids, err
+		}
+	}
+	return ids, nil
+}
+
+// waitLockFree waits until queue, whose segments are used up, is replaced.
+// It starts a preload in case the last one failed. The request has been
+// waiting since start.
+func (this *idAllocator) waitLockFree(ctx context.Context, queue *segQueue, start time.Time) error {
+	// Take the channel before checking the queue, a preload that ends after
+	// the check closes it.
+	loaded := *this.loaded.Load()
+	if this.queue.Load() != queue {
+		return nil
+	}
+
+	this.preloadLockFree()
+	this.Lock()
+	err := this.refusedError()
+	this.Unlock()
+	if err != nil {
+		return err
+	}
+
+	this.waiters.Add(1)
+	defer this.waiters.Add(-1)
+	select {
+	case <-loaded:
+		return nil
+	case <-ctx.Done():
+		if this.queue.Load() != queue {
+			return nil
+		}
+		this.Lock()
+		defer this.Unlock()
+		return this.waitError(ctx, start)
+	}
+}
+
+func (this *idAllocator) preloadLockFree() {
+	// Only one goroutine is preloading at a time
+	if this.closed() || this.refusing() || !this.preloading.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		for this.preloadSegments() {
+		}
+	}()
+}
+
+// preloadSegments fetches segments until prefetch of them are preloaded, the
+// caller set the preloading flag. It reports whether to run again, see
+// preloadDone.
+func (this *idAllocator) preloadSegments() bool {
+	this.waitBackoff()
+	// The queue may have been filled by the last preload after the caller checked.
+	for i := 0; len(this.queue.Load().next) < this.prefetch; i++ {
+		this.refill = i > 0
+		start := time.Now()
+		segConf, err := this.load(this.ctx, this.Key)
+		this.observeLoad(segConf, err, time.Since(start))
+		if err != nil || segConf == nil {
+			this.Lock()
+			this.setPreloadErr(err)
+			this.Unlock()
+			return this.preloadDone(true)
+		}
+
+		next := newIdSegment(0, 0)
+		next.init(segConf)
+
+		this.Lock()
+		this.setPreloadErr(nil)
+		this.Step = segConf.Step
+		this.StepTime = time.Now()
+		this.Unlock()
+
+		// Requests may switch segments meanwhile, only the preload adds them.
+		for {
+			queue := this.queue.Load()
+			nexts := append(queue.next[:len(queue.next):len(queue.next)], next)
+			if this.queue.CompareAndSwap(queue, &segQueue{cur: queue.cur, next: nexts}) {
+				break
+			}
+		}
+		this.notifyLoaded()
+	}
+	return this.preloadDone(false)
+}
+
+// preloadDone clears the preloading flag and wakes up the waiters, so that
+// they can start the next preload. A request which found the queue short
+// while the flag was set did not start one, so the queue is checked again
+// afterwards: it reports whether the preload should go on, having set the
+// flag again. After a failed preload it only goes on for the waiting requests,
+// once the backoff ends, see setPreloadErr.
+func (this *idAllocator) preloadDone(failed bool) bool {
+	this.preloading.Store(false)
+	this.notifyLoaded()
+
+	if this.closed() || this.refusing() || len(this.queue.Load().next) >= this.prefetch {
+		return false
+	}
+	if failed && this.waiters.Load() == 0 {
+		return false
+	}
+	return this.preloading.CompareAndSwap(false, true)
+}
+
+// switchedLockFree starts serving the next segment of queue, once the
+// allocator switched to it.
+func (this *idAllocator) switchedLockFree(queue *segQueue) {
+	next := queue.next[0]
+	next.serve()
+
+	e := segmentEvent(EventSegmentSwitched, this.Key, next)
+	e.Latency = queue.cur.sinceServe()
+	this.observer.Observe(e)
+}
+
+// notifyLoaded wakes up the requests waiting for a preload.
+func (this *idAllocator) notifyLoaded() {
+	loaded := make(chan struct{})
+	close(*this.loaded.Swap(&loaded))
+}
@@ -1,6 +1,7 @@
 package idgen
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"sync/atomic"
@@ -12,14 +13,21 @@ import (
 
 func Test_idAllocator_getNextPos(t *testing.T) {
 
-	f := func(pos int64) idAllocator {
+	f := func(pos int64) *idAllocator {
 		idAlloc := NewidAllocator("test")
 		idAlloc.currentPos = pos
-		return *idAlloc
+		return idAlloc
+	}
+	ring := func(pos int64) *idAllocator {
+		idAlloc := NewidAllocator("test")
+		idAlloc.prefetch = 3
+		idAlloc.Init(&Seg{BizTag: "test", MaxId: 2000, Step: 2000})
+		idAlloc.currentPos = pos
+		return idAlloc
 	}
 	tests := []struct {
 		name    string
-		idAlloc idAllocator
+		idAlloc *idAllocator
 		want    int64
 	}{
 		{
@@ -32,6 +40,16 @@ func Test_idAllocator_getNextPos(t *testing.T) {
 			idAlloc: f(1),
 			want:    0,
 		},
+		{
+			name:    "test ring pos 2",
+			idAlloc: ring(2),
+			want:    3,
+		},
+		{
+			name:    "test ring pos 3",
+			idAlloc: ring(3),
+			want:    0,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -49,7 +67,7 @@ func Test_idAllocator_preload(t *testing.T) {
 	type args struct {
 		f preloadFunc
 	}
-	getIdAlloc := func(isPreload bool) idAllocator {
+	getIdAlloc := func(isPreload bool) *idAllocator {
 		idAlloc := NewidAllocator("test")
 		idAlloc.Init(&Seg{
 			BizTag: "test",
@@ -57,31 +75,31 @@ func Test_idAllocator_preload(t *testing.T) {
 			Step:   2000,
 		})
 		idAlloc.IsPreload = isPreload
-		return *idAlloc
+		return idAlloc
 	}
 
-	succPreloadFunc := func(bizTag string) (*Seg, error) {
+	succPreloadFunc := func(ctx context.Context, bizTag string) (*Seg, error) {
 		return &Seg{
 			BizTag: "test",
 			MaxId:  2000,
 			Step:   2000,
 		}, nil
 	}
-	failPreloadFunc := func(bizTag string) (*Seg, error) {
+	failPreloadFunc := func(ctx context.Context, bizTag string) (*Seg, error) {
 		return nil, errors.New("preload err")
 	}
 
 	tests := []struct {
 		name       string
-		idAlloc    idAllocator
+		idAlloc    *idAllocator
 		args       preloadFunc
-		assertFunc func(idAlloc idAllocator)
+		assertFunc func(idAlloc *idAllocator)
 	}{
 		{
 			name:    "test. in another preload process",
 			idAlloc: getIdAlloc(true),
 			args:    succPreloadFunc,
-			assertFunc: func(idAlloc idAllocator) {
+			assertFunc: func(idAlloc *idAllocator) {
 				assert.Equal(idAlloc.getNextSegment().isInit, false, "test. preload func return err")
 			},
 		},
@@ -89,7 +107,7 @@ func Test_idAllocator_preload(t *testing.T) {
 			name:    "test. preload func return err",
 			idAlloc: getIdAlloc(false),
 			args:    failPreloadFunc,
-			assertFunc: func(idAlloc idAllocator) {
+			assertFunc: func(idAlloc *idAllocator) {
 				assert.Equal(idAlloc.getNextSegment().isInit, false, "test. preload func return err")
 
 			},
@@ -98,7 +116,7 @@ func Test_idAllocator_preload(t *testing.T) {
 			name:    "test. succ",
 			idAlloc: getIdAlloc(false),
 			args:    succPreloadFunc,
-			assertFunc: func(idAlloc idAllocator) {
+			assertFunc: func(idAlloc *idAllocator) {
 				assert.Equal(idAlloc.getNextSegment().isInit, true, "test. succ")
 
 			},
@@ -106,9 +124,14 @@ func Test_idAllocator_preload(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.idAlloc.preload(tt.args)
+			tt.idAlloc.Lock()
+			tt.idAlloc.load = tt.args
+			tt.idAlloc.preload()
+			tt.idAlloc.Unlock()
 			time.Sleep(10 * time.Millisecond)
+			tt.idAlloc.Lock()
 			tt.assertFunc(tt.idAlloc)
+			tt.idAlloc.Unlock()
 		})
 	}
 }
@@ -122,7 +145,7 @@ func Test_idAllocator_NextId(t *testing.T) {
 	var goroutines int = 100
 	var timesPerGoroutine int = 100000
 
-	getNextSeg := func(bizTag string) (*Seg, error) {
+	getNextSeg := func(ctx context.Context, bizTag string) (*Seg, error) {
 		newMaxId := atomic.AddInt64(&maxid, step)
 		return &Seg{
 			BizTag: "test",
@@ -131,21 +154,25 @@ func Test_idAllocator_NextId(t *testing.T) {
 		}, nil
 	}
 
-	getIdAlloc := func() idAllocator {
+	getIdAlloc := func() *idAllocator {
 		idAlloc := NewidAllocator("test")
-		seg, _ := getNextSeg("test")
+		seg, _ := getNextSeg(context.Background(), "test")
+		idAlloc.load = getNextSeg
 		idAlloc.Init(seg)
-		return *idAlloc
+		return idAlloc
 	}
 
 	idAlloc := getIdAlloc()
 
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
 	wg := sync.WaitGroup{}
 	for i := 0; i < goroutines; i++ {
 		wg.Add(1)
 		go func() {
 			for j := 0; j < timesPerGoroutine; j++ {
-				id, err := idAlloc.NextId(getNextSeg)
+				id, err := idAlloc.NextId(ctx)
 
 				// test: Concurrent id generation without error
 				assert.Nil(err, "Concurrent get next id failed. err: %s", func() string {
@@ -172,3 +199,327 @@ func Test_idAllocator_NextId(t *testing.T) {
 	})
 	assert.Equal(goroutines*timesPerGoroutine, count, "id num err: %d", count)
 }
+
+func Test_idAllocator_NextIds(t *testing.T) {
+	assert := assert.New(t)
+	var res sync.Map
+
+	var step int64 = 2000
+	var maxid int64 = 0
+	var goroutines int = 20
+	var timesPerGoroutine int = 100
+	var batch int64 = 333
+
+	getNextSeg := func(ctx context.Context, bizTag string) (*Seg, error) {
+		newMaxId := atomic.AddInt64(&maxid, step)
+		return &Seg{
+			BizTag: "test",
+			MaxId:  newMaxId,
+			Step:   step,
+		}, nil
+	}
+
+	idAlloc := NewidAllocator("test")
+	seg, _ := getNextSeg(context.Background(), "test")
+	idAlloc.load = getNextSeg
+	idAlloc.Init(seg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < timesPerGoroutine; j++ {
+				ids, err := idAlloc.NextIds(ctx, batch)
+				if err != nil {
+					// A failed batch still returns valid ids, they must not be duplicated either.
+					assert.Less(int64(len(ids)), batch, "failed batch returned all ids")
+				} else {
+					assert.Equal(batch, int64(len(ids)), "batch size err")
+				}
+
+				for k, id := range ids {
+					assert.NotEqual(int64(0), id, "id is zero")
+					if k > 0 && ids[k-1] > id {
+						assert.Fail("ids not in order", "prev: %d, id: %d", ids[k-1], id)
+					}
+					_, loaded := res.LoadOrStore(id, 1)
+					assert.Equal(false, loaded, "id duplication: %d", id)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_idAllocator_NextId_burst(t *testing.T) {
+	t.Run("lock", func(t *testing.T) { testNextIdBurst(t, false, 1) })
+	t.Run("lock free", func(t *testing.T) { testNextIdBurst(t, true, 1) })
+	t.Run("lock prefetch", func(t *testing.T) { testNextIdBurst(t, false, 3) })
+	t.Run("lock free prefetch", func(t *testing.T) { testNextIdBurst(t, true, 3) })
+}
+
+func testNextIdBurst(t *testing.T, lockFree bool, prefetch int) {
+	assert := assert.New(t)
+	var res sync.Map
+
+	// Far more requests wait than one segment can serve, and some preloads
+	// fail. Few segments are fetched, so that the test stays fast despite
+	// the store latency.
+	var step int64 = 100
+	var maxid int64 = 0
+	var calls int64 = 0
+	var goroutines int = 200
+	var timesPerGoroutine int = 20
+	var batch int64 = 3
+
+	getNextSeg := func(ctx context.Context, bizTag string) (*Seg, error) {
+		time.Sleep(time.Millisecond)
+		if atomic.AddInt64(&calls, 1)%5 == 0 {
+			return nil, errors.New("store unavailable")
+		}
+		newMaxId := atomic.AddInt64(&maxid, step)
+		return &Seg{
+			BizTag: "test",
+			MaxId:  newMaxId,
+			Step:   step,
+		}, nil
+	}
+
+	idAlloc := NewidAllocator("test")
+	idAlloc.lockFree = lockFree
+	idAlloc.prefetch = prefetch
+	seg, _ := getNextSeg(context.Background(), "test")
+	idAlloc.load = getNextSeg
+	idAlloc.Init(seg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var errs int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < timesPerGoroutine; j++ {
+				var ids []int64
+				var err error
+				if i%2 == 0 {
+					var id int64
+					id, err = idAlloc.NextId(ctx)
+					ids = []int64{id}
+				} else {
+					ids, err = idAlloc.NextIds(ctx, batch)
+				}
+				if err != nil {
+					atomic.AddInt64(&errs, 1)
+					continue
+				}
+
+				for _, id := range ids {
+					assert.NotEqual(int64(0), id, "id is zero")
+					_, loaded := res.LoadOrStore(id, 1)
+					assert.Equal(false, loaded, "id duplication: %d", id)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// test: No request fails while its ctx is not done
+	assert.Equal(int64(0), errs, "requests failed under burst")
+
+	count := 0
+	res.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	assert.Equal(goroutines/2*timesPerGoroutine*int(1+batch), count, "id num err: %d", count)
+}
+
+func Test_idAllocator_prefetch(t *testing.T) {
+	t.Run("lock", func(t *testing.T) { testPrefetch(t, false) })
+	t.Run("lock free", func(t *testing.T) { testPrefetch(t, true) })
+}
+
+// testPrefetch fills 3 segments ahead, then serves them while the store is down.
+func testPrefetch(t *testing.T, lockFree bool) {
+	assert := assert.New(t)
+
+	var step int64 = 100
+	var maxid int64 = 0
+	var down atomic.Bool
+	getNextSeg := func(ctx context.Context, bizTag string) (*Seg, error) {
+		if down.Load() {
+			return nil, errors.New("store unavailable")
+		}
+		newMaxId := atomic.AddInt64(&maxid, step)
+		return &Seg{
+			BizTag: "test",
+			MaxId:  newMaxId,
+			Step:   step,
+		}, nil
+	}
+
+	idAlloc := NewidAllocator("test")
+	idAlloc.lockFree = lockFree
+	idAlloc.prefetch = 3
+	seg, _ := getNextSeg(context.Background(), "test")
+	idAlloc.load = getNextSeg
+	idAlloc.Init(seg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Using 10% of the segment starts the preload.
+	for i := 0; i < 20; i++ {
+		_, err := idAlloc.NextId(ctx)
+		assert.Nil(err, "get id err")
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(int64(4*step), atomic.LoadInt64(&maxid), "3 segments not prefetched")
+
+	// The first and the 3 prefetched segments serve 4 segments' worth of ids.
+	down.Store(true)
+	count := 20
+	for {
+		_, err := idAlloc.NextId(ctx)
+		if err != nil {
+			assert.ErrorIs(err, ErrWaitTimeout, "not a wait timeout")
+			break
+		}
+		count++
+	}
+	assert.Equal(int(4*(step-2)), count, "prefetched ids not served")
+}
+
+func Test_idAllocator_NextId_wait(t *testing.T) {
+	assert := assert.New(t)
+
+	// The preload never finishes within the test.
+	block := make(chan struct{})
+	defer close(block)
+	getNextSeg := func(ctx context.Context, bizTag string) (*Seg, error) {
+		<-block
+		return nil, errors.New("blocked")
+	}
+
+	deadline := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), 50*time.Millisecond)
+	}
+	cancel := func() (context.Context, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		return ctx, cancel
+	}
+
+	tests := []struct {
+		name     string
+		lockFree bool
+		ctx      func() (context.Context, context.CancelFunc)
+		want     error
+	}{
+		{
+			name: "deadline",
+			ctx:  deadline,
+			want: context.DeadlineExceeded,
+		},
+		{
+			name: "cancel",
+			ctx:  cancel,
+			want: context.Canceled,
+		},
+		{
+			name:     "lock free deadline",
+			lockFree: true,
+			ctx:      deadline,
+			want:     context.DeadlineExceeded,
+		},
+		{
+			name:     "lock free cancel",
+			lockFree: true,
+			ctx:      cancel,
+			want:     context.Canceled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idAlloc := NewidAllocator("test")
+			idAlloc.lockFree = tt.lockFree
+			idAlloc.load = getNextSeg
+			idAlloc.Init(&Seg{BizTag: "test", MaxId: 3, Step: 3})
+
+			ctx, cancel := tt.ctx()
+			defer cancel()
+
+			start := time.Now()
+			var err error
+			for i := 0; i < 3 && err == nil; i++ {
+				_, err = idAlloc.NextId(ctx)
+			}
+			assert.ErrorIs(err, ErrWaitTimeout, "not a wait timeout")
+			assert.ErrorIs(err, tt.want, "ctx err not wrapped")
+			assert.Less(time.Since(start), time.Second, "wait not ended by ctx")
+
+			ids, err := idAlloc.NextIds(ctx, 2)
+			assert.Empty(ids, "ids allocated from used up seg")
+			assert.ErrorIs(err, ErrWaitTimeout, "not a wait timeout")
+		})
+	}
+}
+
+func Test_idAllocator_nextStep(t *testing.T) {
+	duration := 10 * time.Minute
+
+	tests := []struct {
+		name    string
+		step    int64
+		elapsed time.Duration
+		want    int64
+	}{
+		{
+			name:    "used up fast, double",
+			step:    1000,
+			elapsed: time.Minute,
+			want:    2000,
+		},
+		{
+			name:    "in duration, keep",
+			step:    1000,
+			elapsed: 15 * time.Minute,
+			want:    1000,
+		},
+		{
+			name:    "lasts long, halve",
+			step:    1000,
+			elapsed: 30 * time.Minute,
+			want:    500,
+		},
+		{
+			name:    "not beyond max step",
+			step:    8000,
+			elapsed: time.Minute,
+			want:    10000,
+		},
+		{
+			name:    "not below min step",
+			step:    150,
+			elapsed: time.Hour,
+			want:    100,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idAlloc := NewidAllocator("test")
+			idAlloc.Step = tt.step
+			idAlloc.StepTime = time.Now().Add(-tt.elapsed)
+			if got := idAlloc.nextStep(duration, 100, 10000); got != tt.want {
+				t.Errorf("idAllocator.nextStep() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
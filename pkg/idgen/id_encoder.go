@@ -0,0 +1,190 @@
+package idgen
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/sqids/sqids-go"
+)
+
+const (
+	Base62Alphabet      = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	Crockford32Alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+// IdEncoder turns the final id into a string, it runs after the filters.
+type IdEncoder interface {
+	Encode(id int64) (string, error)
+	Decode(s string) (int64, error)
+}
+
+// DecimalEncoder encodes ids as decimal strings, it is the default encoder.
+type DecimalEncoder struct{}
+
+func (DecimalEncoder) Encode(id int64) (string, error) {
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (DecimalEncoder) Decode(s string) (int64, error) {
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// BaseEncoder encodes non negative ids in the base of its alphabet, most
+// significant digit first.
+type BaseEncoder struct {
+	alphabet     string
+	index        [256]int8 // Digit of each character, -1 when invalid
+	ignoreHyphen bool
+}
+
+// NewBase62Encoder creates a Base62 encoder. The alphabet must have 62 unique
+// ascii characters, an empty alphabet means Base62Alphabet.
+func NewBase62Encoder(alphabet string) (*BaseEncoder, error) {
+	if alphabet == "" {
+		alphabet = Base62Alphabet
+	}
+	if len(alphabet) != 62 {
+		return nil, fmt.Errorf("base62 alphabet should have 62 characters, got %d", len(alphabet))
+	}
+	return newBaseEncoder(alphabet)
+}
+
+// NewCrockford32Encoder creates a Crockford Base32 encoder. Decoding is case
+// insensitive, accepts 'O' as '0', 'I' and 'L' as '1', and ignores '-'.
+func NewCrockford32Encoder() *BaseEncoder {
+	enc, _ := newBaseEncoder(Crockford32Alphabet)
+	enc.ignoreHyphen = true
+	for i := 0; i < len(Crockford32Alphabet); i++ {
+		if c := Crockford32Alphabet[i]; c >= 'A' && c <= 'Z' {
+			enc.index[c+'a'-'A'] = enc.index[c]
+		}
+	}
+	for _, alias := range []string{"O0", "o0", "I1", "i1", "L1", "l1"} {
+		enc.index[alias[0]] = enc.index[alias[1]]
+	}
+	return enc
+}
+
+func newBaseEncoder(alphabet string) (*BaseEncoder, error) {
+	enc := &BaseEncoder{alphabet: alphabet}
+	for i := range enc.index {
+		enc.index[i] = -1
+	}
+	for i := 0; i < len(alphabet); i++ {
+		c := alphabet[i]
+		if c >= 0x80 || enc.index[c] >= 0 {
+			return nil, fmt.Errorf("alphabet should have unique ascii characters: %q", alphabet)
+		}
+		enc.index[c] = int8(i)
+	}
+	return enc, nil
+}
+
+func (this *BaseEncoder) Encode(id int64) (string, error) {
+	if id < 0 {
+		return "", fmt.Errorf("encode negative id %d", id)
+	}
+	if id == 0 {
+		return this.alphabet[:1], nil
+	}
+
+	base := int64(len(this.alphabet))
+	buf := make([]byte, 0, 13)
+	for ; id > 0; id /= base {
+		buf = append(buf, this.alphabet[id%base])
+	}
+	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+	return string(buf), nil
+}
+
+func (this *BaseEncoder) Decode(s string) (int64, error) {
+	base := int64(len(this.alphabet))
+	var id int64
+	digits := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '-' && this.ignoreHyphen {
+			continue
+		}
+		d := this.index[s[i]]
+		if d < 0 {
+			return 0, fmt.Errorf("decode %q: invalid character %q", s, s[i])
+		}
+		if id > (math.MaxInt64-int64(d))/base {
+			return 0, fmt.Errorf("decode %q: overflow", s)
+		}
+		id = id*base + int64(d)
+		digits++
+	}
+	if digits == 0 {
+		return 0, fmt.Errorf("decode empty id")
+	}
+	return id, nil
+}
+
+// SqidsEncoder encodes ids with Sqids (https://sqids.org), which shuffles the
+// alphabet so that consecutive ids do not look alike and avoids words in the
+// blocklist.
+type SqidsEncoder struct {
+	sqids *sqids.Sqids
+}
+
+// NewSqidsEncoder creates a Sqids encoder. An empty alphabet means the default
+// Sqids alphabet, a nil blocklist means the default Sqids blocklist.
+func NewSqidsEncoder(alphabet string, minLength uint8, blocklist []string) (*SqidsEncoder, error) {
+	s, err := sqids.New(sqids.Options{
+		Alphabet:  alphabet,
+		MinLength: minLength,
+		Blocklist: blocklist,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SqidsEncoder{sqids: s}, nil
+}
+
+func (this *SqidsEncoder) Encode(id int64) (string, error) {
+	if id < 0 {
+		return "", fmt.Errorf("encode negative id %d", id)
+	}
+	return this.sqids.Encode([]uint64{uint64(id)})
+}
+
+func (this *SqidsEncoder) Decode(s string) (int64, error) {
+	numbers := this.sqids.Decode(s)
+	if len(numbers) != 1 || numbers[0] > math.MaxInt64 {
+		return 0, fmt.Errorf("decode %q: invalid sqids id", s)
+	}
+
+	// Several strings decode to the same number, only the canonical one is accepted.
+	if canonical, err := this.sqids.Encode(numbers); err != nil || canonical != s {
+		return 0, fmt.Errorf("decode %q: not a canonical sqids id", s)
+	}
+	return int64(numbers[0]), nil
+}
+
+// NewIdEncoder creates an encoder by name: decimal, base62, base32 (Crockford)
+// or sqids with the default alphabet and blocklist.
+func NewIdEncoder(name string) (IdEncoder, error) {
+	switch strings.ToLower(name) {
+	case "decimal":
+		return DecimalEncoder{}, nil
+	case "base62":
+		return NewBase62Encoder("")
+	case "base32":
+		return NewCrockford32Encoder(), nil
+	case "sqids":
+		return NewSqidsEncoder("", 0, nil)
+	}
+	return nil, fmt.Errorf("unknown id encoder: %s", name)
+}
+
+// WithIdEncoder sets the encoder used by GetIdString and GetIdsString.
+func WithIdEncoder(encoder IdEncoder) Option {
+	return func(idgen *IdGenerator) {
+		idgen.encoder = encoder
+	}
+}
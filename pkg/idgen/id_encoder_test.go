@@ -0,0 +1,132 @@
+package idgen
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdEncoder(t *testing.T) {
+	assert := assert.New(t)
+
+	base62, _ := NewBase62Encoder("")
+	sqidsEnc, err := NewSqidsEncoder("", 0, nil)
+	assert.Nil(err, "new sqids encoder err")
+
+	encoders := map[string]IdEncoder{
+		"decimal": DecimalEncoder{},
+		"base62":  base62,
+		"base32":  NewCrockford32Encoder(),
+		"sqids":   sqidsEnc,
+	}
+
+	ids := []int64{0, 1, 61, 62, 1 << 32, math.MaxInt64}
+	for i := 0; i < 1000; i++ {
+		ids = append(ids, rand.Int63())
+	}
+
+	for name, enc := range encoders {
+		for _, id := range ids {
+			s, err := enc.Encode(id)
+			assert.Nil(err, "%s encode err", name)
+			got, err := enc.Decode(s)
+			assert.Nil(err, "%s decode err, str: %s", name, s)
+			assert.Equal(id, got, "%s decode mismatch, str: %s", name, s)
+		}
+		_, err := enc.Encode(-1)
+		if name != "decimal" {
+			assert.NotNil(err, "%s should not encode negative id", name)
+		}
+	}
+}
+
+func TestBaseEncoder(t *testing.T) {
+	assert := assert.New(t)
+
+	base62, _ := NewBase62Encoder("")
+	s, _ := base62.Encode(62)
+	assert.Equal("10", s, "base62 encode")
+	s, _ = base62.Encode(math.MaxInt64)
+	assert.Equal("AzL8n0Y58m7", s, "base62 encode max int64")
+
+	_, err := base62.Decode("AzL8n0Y58m8")
+	assert.NotNil(err, "base62 decode overflow")
+	_, err = base62.Decode("a-b")
+	assert.NotNil(err, "base62 decode invalid char")
+	_, err = base62.Decode("")
+	assert.NotNil(err, "base62 decode empty")
+
+	_, err = NewBase62Encoder("abc")
+	assert.NotNil(err, "base62 short alphabet")
+
+	// test: Crockford decoding aliases
+	base32 := NewCrockford32Encoder()
+	s, _ = base32.Encode(0x1234567)
+	assert.Equal("J6HB7", s, "base32 encode")
+	for _, str := range []string{"J6HB7", "j6hb7", "J6-HB7"} {
+		id, err := base32.Decode(str)
+		assert.Nil(err, "base32 decode %s", str)
+		assert.Equal(int64(0x1234567), id, "base32 decode %s", str)
+	}
+	one, _ := base32.Decode("1")
+	for _, str := range []string{"I", "i", "L", "l"} {
+		id, err := base32.Decode(str)
+		assert.Nil(err, "base32 decode %s", str)
+		assert.Equal(one, id, "base32 alias %s", str)
+	}
+	_, err = base32.Decode("U")
+	assert.NotNil(err, "base32 decode invalid char")
+}
+
+func TestSqidsEncoder(t *testing.T) {
+	assert := assert.New(t)
+
+	// test: custom alphabet and blocklist
+	enc, err := NewSqidsEncoder("abcdefghijklmnopqrstuvwxyz", 8, []string{})
+	assert.Nil(err, "new sqids encoder err")
+	s, err := enc.Encode(12345)
+	assert.Nil(err, "sqids encode err")
+	assert.GreaterOrEqual(len(s), 8, "sqids min length")
+	for _, c := range s {
+		assert.True(c >= 'a' && c <= 'z', "sqids char out of alphabet: %s", s)
+	}
+
+	blocked, _ := NewSqidsEncoder("abcdefghijklmnopqrstuvwxyz", 8, []string{s})
+	s2, err := blocked.Encode(12345)
+	assert.Nil(err, "sqids encode err")
+	assert.NotEqual(s, s2, "blocked word returned")
+	id, err := blocked.Decode(s2)
+	assert.Nil(err, "sqids decode err")
+	assert.Equal(int64(12345), id, "sqids decode")
+
+	// test: only canonical strings are accepted
+	_, err = enc.Decode(s + "a")
+	assert.NotNil(err, "non canonical sqids id accepted")
+}
+
+func TestIdGenerator_GetIdString(t *testing.T) {
+	assert := assert.New(t)
+	store := storeDemo{}
+
+	base62, _ := NewBase62Encoder("")
+	idGen := NewIdGenrator(&store, WithIdEncoder(base62))
+	s, err := idGen.GetIdString(context.Background(), "test")
+	assert.Nil(err, "get id string err")
+	id, err := base62.Decode(s)
+	assert.Nil(err, "decode err")
+	assert.NotEqual(int64(0), id, "id is zero")
+
+	strs, err := idGen.GetIdsString(context.Background(), "test", 10)
+	assert.Nil(err, "get ids string err")
+	assert.Equal(10, len(strs), "ids num err")
+
+	// test: decimal by default
+	idGen = NewIdGenrator(&store)
+	s, err = idGen.GetIdString(context.Background(), "test")
+	assert.Nil(err, "get id string err")
+	_, err = DecimalEncoder{}.Decode(s)
+	assert.Nil(err, "not decimal: %s", s)
+}
@@ -0,0 +1,108 @@
+package idgen
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+const feistelRounds = 8
+
+// FeistelCipher is a keyed permutation of the 63bit id space [0, 2^63).
+// Unlike AddRandomFilter it does not take up any bit of the id and can be
+// reversed with the key, so the raw id can be recovered for debugging or
+// sharding.
+//
+// It is a balanced Feistel network over 64 bits (two 32bit halves) with cycle
+// walking: the network is applied again until the result falls below 2^63,
+// which keeps the mapping one to one on [0, 2^63).
+// It is meant to obfuscate sequential ids, not to encrypt them.
+type FeistelCipher struct {
+	roundKeys [feistelRounds]uint64
+}
+
+func NewFeistelCipher(key []byte) *FeistelCipher {
+	c := &FeistelCipher{}
+	for i := range c.roundKeys {
+		h := sha256.Sum256(append([]byte{byte(i)}, key...))
+		c.roundKeys[i] = binary.BigEndian.Uint64(h[:8])
+	}
+	return c
+}
+
+// Encode maps a raw id to its public id.
+func (this *FeistelCipher) Encode(id int64) (int64, error) {
+	if id < 0 {
+		return id, fmt.Errorf("feistel encode negative id %d", id)
+	}
+	x := uint64(id)
+	for {
+		x = this.encrypt(x)
+		if x>>63 == 0 {
+			return int64(x), nil
+		}
+	}
+}
+
+// Decode maps a public id back to the raw id.
+func (this *FeistelCipher) Decode(id int64) (int64, error) {
+	if id < 0 {
+		return id, fmt.Errorf("feistel decode negative id %d", id)
+	}
+	x := uint64(id)
+	for {
+		x = this.decrypt(x)
+		if x>>63 == 0 {
+			return int64(x), nil
+		}
+	}
+}
+
+func (this *FeistelCipher) encrypt(x uint64) uint64 {
+	l, r := uint32(x>>32), uint32(x)
+	for _, k := range this.roundKeys {
+		l, r = r, l^feistelRound(r, k)
+	}
+	return uint64(l)<<32 | uint64(r)
+}
+
+func (this *FeistelCipher) decrypt(x uint64) uint64 {
+	l, r := uint32(x>>32), uint32(x)
+	for i := len(this.roundKeys) - 1; i >= 0; i-- {
+		l, r = r^feistelRound(l, this.roundKeys[i]), l
+	}
+	return uint64(l)<<32 | uint64(r)
+}
+
+// feistelRound is the round function, the splitmix64 finalizer of the keyed half.
+func feistelRound(r uint32, k uint64) uint32 {
+	z := uint64(r) ^ k
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return uint32(z >> 32)
+}
+
+// FeistelFilter returns a filter that maps ids one to one with the key,
+// see FeistelCipher. Use FeistelDecode with the same key to recover the raw id.
+func FeistelFilter(key []byte) IdFilter {
+	return NewFeistelCipher(key).Encode
+}
+
+// FeistelDecode recovers the raw id of an id produced by FeistelFilter with key.
+func FeistelDecode(key []byte, id int64) (int64, error) {
+	return NewFeistelCipher(key).Decode(id)
+}
+
+// A filter that permutes the 63bit id space with a keyed Feistel network.
+/*
+			+-----------------------+
+			|0|00000.........00000|
+			+-----------------------+
+1bit reserved     63bit permuted id
+*/
+func WithFeistelFilter(key []byte) Option {
+	return func(idgen *IdGenerator) {
+		idgen.filters = append(idgen.filters, FeistelFilter(key))
+	}
+}
@@ -0,0 +1,62 @@
+package idgen
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeistelCipher(t *testing.T) {
+	assert := assert.New(t)
+	c := NewFeistelCipher([]byte("secret"))
+
+	ids := []int64{0, 1, 2, 3, 1 << 32, math.MaxInt64, math.MaxInt64 - 1}
+	for i := 0; i < 10000; i++ {
+		ids = append(ids, rand.Int63())
+	}
+
+	for _, id := range ids {
+		enc, err := c.Encode(id)
+		assert.Nil(err, "encode err")
+		assert.GreaterOrEqual(enc, int64(0), "encoded id out of 63bit space: %d", enc)
+
+		dec, err := c.Decode(enc)
+		assert.Nil(err, "decode err")
+		assert.Equal(id, dec, "decode mismatch, encoded: %d", enc)
+	}
+
+	_, err := c.Encode(-1)
+	assert.NotNil(err, "negative id should fail")
+}
+
+func TestFeistelFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	// test: consecutive ids are mapped one to one and not consecutive
+	f := FeistelFilter([]byte("secret"))
+	seen := make(map[int64]bool)
+	var prev int64
+	consecutive := 0
+	for id := int64(1); id <= 100000; id++ {
+		enc, err := f(id)
+		assert.Nil(err, "filter err")
+		assert.False(seen[enc], "feistel filter collision: %d", enc)
+		seen[enc] = true
+		if enc == prev+1 {
+			consecutive++
+		}
+		prev = enc
+	}
+	assert.Less(consecutive, 10, "filtered ids are consecutive")
+
+	// test: the key matters
+	a, _ := FeistelFilter([]byte("key-a"))(12345)
+	b, _ := FeistelFilter([]byte("key-b"))(12345)
+	assert.NotEqual(a, b, "different keys give the same id")
+
+	raw, err := FeistelDecode([]byte("key-a"), a)
+	assert.Nil(err, "decode err")
+	assert.Equal(int64(12345), raw, "decode mismatch")
+}
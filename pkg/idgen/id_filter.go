@@ -18,7 +18,7 @@ func AddRandomFilter(bit uint) func(id int64) (int64, error) {
 
 	return func(id int64) (int64, error) {
 		if checkOverFlow(id, bit) {
-			return id, fmt.Errorf("AddRandomFilter %d overflow", bit)
+			return id, fmt.Errorf("AddRandomFilter %d: %w", bit, ErrFilterOverflow)
 		}
 		randId := rand.Intn(1 << bit)
 		return ((id << bit) + int64(randId)), nil
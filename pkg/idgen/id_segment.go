@@ -1,12 +1,16 @@
 package idgen
 
-import "sync/atomic"
+import (
+	"sync/atomic"
+	"time"
+)
 
 type idSegment struct {
 	Max    int64
 	Min    int64
 	Cur    int64
 	isInit bool
+	start  int64 // Unix nano the segment started serving ids, used to estimate the consumption rate
 }
 
 func newIdSegment(max int64, step int64) *idSegment {
@@ -19,9 +23,20 @@ func (this *idSegment) init(conf *Seg) {
 	this.Max = conf.MaxId - 1
 	this.Min = conf.MaxId - conf.Step
 	this.Cur = this.Min
+	this.start = time.Now().UnixNano()
 	this.isInit = true
 }
 
+// serve marks the time the segment becomes the one in use.
+func (this *idSegment) serve() {
+	atomic.StoreInt64(&this.start, time.Now().UnixNano())
+}
+
+// sinceServe returns the time the segment has been in use.
+func (this *idSegment) sinceServe() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&this.start))
+}
+
 func (this *idSegment) getNext() int64 {
 	id := atomic.AddInt64(&this.Cur, 1)
 	if id >= this.Max {
@@ -30,17 +45,80 @@ func (this *idSegment) getNext() int64 {
 	return id
 }
 
-func (this *idSegment) needPreLoad() bool {
-	return this.Max-this.Cur < int64(0.9*float32(this.Max-this.Min))
+// getRange takes up to n ids from the segment in one step and returns the
+// first id and the number of ids taken. count is 0 when the segment is used up.
+func (this *idSegment) getRange(n int64) (start int64, count int64) {
+	// n is clamped to the ids left, and one more to mark the segment used
+	// up, so that Cur does not overflow
+	if left := this.Max - atomic.LoadInt64(&this.Cur); n > left {
+		if left <= 0 {
+			return 0, 0
+		}
+		n = left
+	}
+	end := atomic.AddInt64(&this.Cur, n)
+	start = end - n + 1
+	if end >= this.Max {
+		end = this.Max - 1
+	}
+	if start > end {
+		return 0, 0
+	}
+	return start, end - start + 1
+}
+
+// needPreLoad reports whether the next segment should be preloaded. By
+// default it is when the share of ids left drops below ratio. When within is
+// not 0, it is when the ids left are expected to run out within it at the
+// rate the segment has been used so far.
+func (this *idSegment) needPreLoad(ratio float64, within time.Duration) bool {
+	cur := atomic.LoadInt64(&this.Cur)
+	left := this.Max - cur
+	if within <= 0 {
+		return left < int64(ratio*float64(this.Max-this.Min))
+	}
+
+	used := cur - this.Min
+	if left <= 0 {
+		return true
+	}
+	// The rate is not estimated until 1% of the segment is used, the first
+	// ids may come in a burst.
+	if used <= 0 || used < (this.Max-this.Min)/100 {
+		return false
+	}
+	elapsed := time.Now().UnixNano() - atomic.LoadInt64(&this.start)
+	return float64(left)*float64(elapsed) < float64(within)*float64(used)
+}
+
+// remaining returns the number of ids left in the segment.
+func (this *idSegment) remaining() int64 {
+	if !this.isInit {
+		return 0
+	}
+	if left := this.Max - 1 - atomic.LoadInt64(&this.Cur); left > 0 {
+		return left
+	}
+	return 0
+}
+
+func (this *idSegment) stats() SegmentStats {
+	return SegmentStats{
+		Min:    this.Min,
+		Cur:    atomic.LoadInt64(&this.Cur),
+		Max:    this.Max,
+		IsInit: this.isInit,
+	}
 }
 
 func (this *idSegment) full() bool {
-	return this.Cur >= this.Max
+	return atomic.LoadInt64(&this.Cur) >= this.Max
 }
 
 func (this *idSegment) clear() {
 	this.Max = 0
 	this.Min = 0
 	this.Cur = 0
+	this.start = 0
 	this.isInit = false
 }
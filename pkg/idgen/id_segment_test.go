@@ -4,6 +4,7 @@ import (
 	"math"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -37,3 +38,122 @@ func Test_idSegment_getNext(t *testing.T) {
 
 	assert.Equal(want, int64(0), "Out of seg boundary.")
 }
+
+func Test_idSegment_getRange(t *testing.T) {
+	assert := assert.New(t)
+
+	idSeg := &idSegment{}
+	idSeg.init(&Seg{
+		BizTag: "test",
+		MaxId:  100,
+		Step:   100,
+	})
+
+	start, count := idSeg.getRange(10)
+	assert.Equal(int64(1), start, "first range start")
+	assert.Equal(int64(10), count, "first range count")
+
+	start, count = idSeg.getRange(1000)
+	assert.Equal(int64(11), start, "range across boundary start")
+	assert.Equal(int64(88), count, "range across boundary count")
+
+	start, count = idSeg.getRange(10)
+	assert.Equal(int64(0), count, "range of used up seg, start: %d", start)
+	assert.True(idSeg.full(), "seg should be full")
+
+	// test: a count too large does not overflow the segment
+	idSeg.init(&Seg{
+		BizTag: "test",
+		MaxId:  100,
+		Step:   100,
+	})
+	start, count = idSeg.getRange(math.MaxInt64 - 1000)
+	assert.Equal(int64(1), start, "huge range start")
+	assert.Equal(int64(98), count, "huge range count")
+	assert.True(idSeg.full(), "seg should be full")
+	start, count = idSeg.getRange(math.MaxInt64)
+	assert.Equal(int64(0), count, "range of used up seg, start: %d", start)
+	assert.Equal(idSeg.Max, idSeg.Cur, "cur should not overflow")
+}
+
+func Test_idSegment_needPreLoad(t *testing.T) {
+	// A segment of ids (0, 1000), in use for a minute.
+	newSeg := func(used int64) *idSegment {
+		idSeg := &idSegment{}
+		idSeg.init(&Seg{
+			BizTag: "test",
+			MaxId:  1001,
+			Step:   1001,
+		})
+		idSeg.Cur += used
+		idSeg.start = time.Now().Add(-time.Minute).UnixNano()
+		return idSeg
+	}
+
+	tests := []struct {
+		name   string
+		used   int64
+		ratio  float64
+		within time.Duration
+		want   bool
+	}{
+		{
+			name:  "ratio, 5% used",
+			used:  50,
+			ratio: DefaultPreloadRatio,
+			want:  false,
+		},
+		{
+			name:  "ratio, 15% used",
+			used:  150,
+			ratio: DefaultPreloadRatio,
+			want:  true,
+		},
+		{
+			name:  "ratio 0.5, 40% used",
+			used:  400,
+			ratio: 0.5,
+			want:  false,
+		},
+		{
+			name:  "ratio 0.5, 60% used",
+			used:  600,
+			ratio: 0.5,
+			want:  true,
+		},
+		{
+			name:   "time, unused",
+			used:   0,
+			ratio:  DefaultPreloadRatio,
+			within: time.Minute,
+			want:   false,
+		},
+		{
+			name:   "time, 3 minutes left",
+			used:   250,
+			ratio:  DefaultPreloadRatio,
+			within: 2 * time.Minute,
+			want:   false,
+		},
+		{
+			name:   "time, 1 minute left",
+			used:   500,
+			ratio:  DefaultPreloadRatio,
+			within: 2 * time.Minute,
+			want:   true,
+		},
+		{
+			name:   "time, used up",
+			used:   2000,
+			ratio:  DefaultPreloadRatio,
+			within: time.Second,
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newSeg(tt.used).needPreLoad(tt.ratio, tt.within)
+			assert.Equal(t, tt.want, got, "used: %d", tt.used)
+		})
+	}
+}
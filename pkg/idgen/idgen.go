@@ -5,31 +5,52 @@ import (
 	"fmt"
 	"reflect"
 	"runtime"
+	"sync"
 	"time"
 )
 
 const (
-	MaxStep               = 10e7
-	DefaultStep           = 2000            // default step
-	DefaultRetry          = 3               // default retry times when id allocator preload next segment
-	DefaultPreloadTimeout = 3 * time.Second // default timeout  when id allocator preload next segment
+	MaxStep                  = 10e7
+	DefaultStep              = 2000                  // default step
+	DefaultRetry             = 3                     // default retry times when id allocator preload next segment
+	DefaultPreloadTimeout    = 3 * time.Second       // default timeout  when id allocator preload next segment
+	DefaultPreloadBackoff    = 50 * time.Millisecond // default backoff before the first retry of a preload
+	DefaultPreloadMaxBackoff = time.Second           // default cap of the backoff between the retries of a preload
+	DefaultStepDuration      = 15 * time.Minute      // default duration a segment should last when adaptive step is enabled
+	DefaultWaitTimeout       = 2 * time.Second       // default time a request waits for the next segment when its context has no deadline
+	DefaultPrefetch          = 1                     // default number of segments preloaded ahead of the one in use
+	DefaultPreloadRatio      = 0.9                   // default share of ids left in the segment below which the next one is preloaded
+	MaxIdCount               = 1 << 20               // max number of ids of one GetIds call
 )
 
+// Generator is implemented by the segment mode IdGenerator and the
+// SnowflakeGenerator, so that callers can pick a mode per bizTag.
+type Generator interface {
+	GetId(ctx context.Context, bizTag string) (int64, error)
+	GetIds(ctx context.Context, bizTag string, n int) ([]int64, error)
+}
+
 type IdGenerator struct {
-	cache      *bizCache     // Cache that each biztag has obtained segments on the local machine that can be used for allocation
-	expireTime time.Duration // Cache expire time. When it is 0, it will never expire
-	step       int64         // When no biztag info is stored, the initialization is done using step
+	cache       *bizCache     // Cache that each biztag has obtained segments on the local machine that can be used for allocation
+	expireTime  time.Duration // Cache expire time. When it is 0, it will never expire
+	waitTimeout time.Duration // Time a request waits for the next segment when its context has no deadline
 
 	store IdStore
 
-	preloadRetryTimes int
-	preloadTimeout    time.Duration
+	// Default settings of the bizTags, set by the Options.
+	bizTagConfig
+
+	bizTagOpts  map[string][]BizTagOption // Overrides given by WithBizTagConfig
+	bizTagConfs map[string]*bizTagConfig  // Settings of the bizTags with overrides, built from bizTagOpts
+	defaultConf *bizTagConfig             // Settings of the other bizTags
+
+	observers observers // Registered by WithObserver
 
-	// Filter for Post-processing of 'ID'.
-	// Due to the use of 'ID segmentation', the obtained raw IDs are sequentially incremented,
-	// which may be maliciously exploited for traversal. If there is a need to obfuscate the
-	// IDs, filters can be used.
-	filters []IdFilter
+	watermark       WatermarkStore // High water marks of the bizTags, nil when unchecked
+	watermarkPolicy WatermarkPolicy
+
+	initMutex sync.Mutex
+	initCalls map[string]*bizTagCall // In-flight initializations of bizTags, see AddBizTag
 }
 
 type Option func(*IdGenerator)
@@ -46,6 +67,91 @@ func WithPreloadTimeout(timeout time.Duration) Option {
 	}
 }
 
+// WithWaitTimeout sets how long a request waits for the next segment when
+// its context has no deadline. A request with a deadline waits until it.
+func WithWaitTimeout(timeout time.Duration) Option {
+	if timeout <= 0 {
+		timeout = DefaultWaitTimeout
+	}
+	return func(idgen *IdGenerator) {
+		idgen.waitTimeout = timeout
+	}
+}
+
+// WithLockFree makes the allocators serve ids with atomics only and switch
+// segments with a CAS, instead of taking a lock for each id. It raises the
+// throughput of a hot bizTag under concurrency.
+func WithLockFree() Option {
+	return func(idgen *IdGenerator) {
+		idgen.lockFree = true
+	}
+}
+
+// WithPrefetch sets the number of segments preloaded ahead of the one in use,
+// 1 by default. The preload keeps fetching segments in the background until
+// n of them are ready, so that a slow or unavailable store is absorbed by
+// n segments' worth of ids.
+func WithPrefetch(n int) Option {
+	if n < 1 {
+		n = DefaultPrefetch
+	}
+	return func(idgen *IdGenerator) {
+		idgen.prefetch = n
+	}
+}
+
+// WithPreloadRatio sets when the next segment is preloaded: once the share of
+// ids left in the current segment drops below ratio, 0.9 by default, i.e.
+// when 10% of it is used. A ratio out of (0, 1] means the default.
+func WithPreloadRatio(ratio float64) Option {
+	if ratio <= 0 || ratio > 1 {
+		ratio = DefaultPreloadRatio
+	}
+	return func(idgen *IdGenerator) {
+		idgen.preloadRatio = ratio
+	}
+}
+
+// WithPreloadTime makes the next segment preloaded when the ids left in the
+// current segment are expected to run out within d, estimated from the rate
+// the segment has been used so far. It takes the place of WithPreloadRatio,
+// so that bizTags with low traffic do not preload segments long before they
+// are needed.
+func WithPreloadTime(d time.Duration) Option {
+	if d < 0 {
+		d = 0
+	}
+	return func(idgen *IdGenerator) {
+		idgen.preloadTime = d
+	}
+}
+
+// WithPreloadBackoff sets the backoff between the retries of a failed fetch
+// of a segment. It starts at backoff and doubles at each retry up to
+// maxBackoff, 50ms and 1s by default. Each backoff is jittered in [d/2, d],
+// so that the bizTags failed by the same store outage spread their retries.
+// The backoff goes on doubling across the failed preloads, until one
+// succeeds, so that the waiting requests do not restart them at once.
+// A bizTag refused by the store, e.g. disabled, is not fetched again before
+// maxBackoff, its requests fail at once meanwhile.
+func WithPreloadBackoff(backoff time.Duration, maxBackoff time.Duration) Option {
+	backoff, maxBackoff = preloadBackoff(backoff, maxBackoff)
+	return func(idgen *IdGenerator) {
+		idgen.preloadBackoff = backoff
+		idgen.preloadMaxBackoff = maxBackoff
+	}
+}
+
+func preloadBackoff(backoff time.Duration, maxBackoff time.Duration) (time.Duration, time.Duration) {
+	if backoff <= 0 {
+		backoff = DefaultPreloadBackoff
+	}
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	return backoff, maxBackoff
+}
+
 func WithPreloadRetryTimes(times int) Option {
 	return func(idgen *IdGenerator) {
 		idgen.preloadRetryTimes = times
@@ -64,6 +170,25 @@ func WithStep(step int64) Option {
 	}
 }
 
+// WithAdaptiveStep enables adaptive step (Leaf style dynamic step). When a
+// segment of a bizTag is used up in less than duration, the next segment is
+// requested with twice the step; when it lasts more than twice the duration,
+// with half the step. The step stays within [minStep, MaxStep], a minStep <= 0
+// means the step set by WithStep.
+// The store must implement DynamicStepStore, otherwise the step is not adapted.
+func WithAdaptiveStep(duration time.Duration, minStep int64) Option {
+	if duration <= 0 {
+		duration = DefaultStepDuration
+	}
+	if minStep > MaxStep {
+		minStep = MaxStep
+	}
+	return func(idgen *IdGenerator) {
+		idgen.stepDuration = duration
+		idgen.minStep = minStep
+	}
+}
+
 func WithIdFilter(filters []IdFilter) Option {
 	return func(idgen *IdGenerator) {
 		idgen.filters = append(idgen.filters, filters...)
@@ -72,18 +197,34 @@ func WithIdFilter(filters []IdFilter) Option {
 
 func NewIdGenrator(store IdStore, opts ...Option) *IdGenerator {
 	idGen := &IdGenerator{
-		store:             store,
-		preloadRetryTimes: DefaultRetry,
-		expireTime:        0,
-		step:              DefaultStep,
-		preloadTimeout:    DefaultPreloadTimeout,
+		store:       store,
+		expireTime:  0,
+		waitTimeout: DefaultWaitTimeout,
+		bizTagConfig: bizTagConfig{
+			step:              DefaultStep,
+			preloadRetryTimes: DefaultRetry,
+			preloadTimeout:    DefaultPreloadTimeout,
+			preloadBackoff:    DefaultPreloadBackoff,
+			preloadMaxBackoff: DefaultPreloadMaxBackoff,
+			encoder:           DecimalEncoder{},
+			prefetch:          DefaultPrefetch,
+			preloadRatio:      DefaultPreloadRatio,
+		},
+		bizTagOpts:  make(map[string][]BizTagOption),
+		bizTagConfs: make(map[string]*bizTagConfig),
+		initCalls:   make(map[string]*bizTagCall),
 	}
 
 	for _, o := range opts {
 		o(idGen)
 	}
 
-	idGen.cache = newBizCache(idGen.expireTime)
+	for bizTag, bizTagOpts := range idGen.bizTagOpts {
+		idGen.bizTagConfs[bizTag] = newBizTagConfig(idGen.bizTagConfig, bizTagOpts)
+	}
+	idGen.defaultConf = newBizTagConfig(idGen.bizTagConfig, nil)
+
+	idGen.cache = newBizCache(idGen.expireTime, idGen.observers)
 	return idGen
 }
 
@@ -99,50 +240,245 @@ func (this *IdGenerator) GetId(ctx context.Context, bizTag string) (int64, error
 		}
 	}
 
-	ctxPreload, _ := context.WithTimeout(context.Background(), this.preloadTimeout)
+	id, err := idAlloc.NextId(ctx)
+	if err != nil {
+		return 0, err
+	}
 
-	// Specifies the function used for preload in allocator
-	preload := func(bizTag string) (*Seg, error) {
-		var seg *Seg
+	return this.config(bizTag).filter(bizTag, id)
+}
+
+// GetIds allocates n ids of bizTag in one call. The ids are taken from the
+// current segment in one step, spilling into the preloaded segment (or a new
+// segment fetched from the store) when the current one is used up, and every
+// id is passed through the filters. The ids are returned in allocation order.
+//
+// Partial failure: when allocation or a filter fails midway, GetIds returns
+// the ids that were successfully allocated and filtered before the failure
+// together with the error. Those ids are valid and will never be issued again,
+// so the caller may keep them or drop them. The raw ids consumed after the
+// failure point are discarded.
+func (this *IdGenerator) GetIds(ctx context.Context, bizTag string, n int) ([]int64, error) {
+	if err := checkIdCount(n); err != nil {
+		return nil, err
+	}
+
+	idAlloc := this.cache.get(bizTag)
+	if idAlloc == nil {
 		var err error
-		for i := 0; i <= this.preloadRetryTimes; i++ {
-			seg, err = this.store.GetNextSegment(ctxPreload, bizTag, this.step)
-			if err == nil {
-				return seg, nil
-			}
+		idAlloc, err = this.AddBizTag(ctx, bizTag)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ids, allocErr := idAlloc.NextIds(ctx, int64(n))
+
+	conf := this.config(bizTag)
+	for i, id := range ids {
+		id, err := conf.filter(bizTag, id)
+		if err != nil {
+			return ids[:i], err
 		}
-		return seg, err
+		ids[i] = id
 	}
+	return ids, allocErr
+}
 
-	id, err := idAlloc.NextId(preload)
+// checkIdCount returns ErrInvalidCount when n is not in [1, MaxIdCount].
+func checkIdCount(n int) error {
+	if n <= 0 || n > MaxIdCount {
+		return fmt.Errorf("%w: %d, should be in [1, %d]", ErrInvalidCount, n, MaxIdCount)
+	}
+	return nil
+}
+
+// GetIdString is GetId with the id encoded by the encoder set by WithIdEncoder
+// or WithBizTagIdEncoder, decimal by default.
+func (this *IdGenerator) GetIdString(ctx context.Context, bizTag string) (string, error) {
+	id, err := this.GetId(ctx, bizTag)
 	if err != nil {
-		return 0, err
+		return "", err
 	}
+	return this.config(bizTag).encoder.Encode(id)
+}
 
+// GetIdsString is GetIds with the ids encoded like GetIdString.
+// On failure the ids encoded so far are returned along with the error.
+func (this *IdGenerator) GetIdsString(ctx context.Context, bizTag string, n int) ([]string, error) {
+	ids, err := this.GetIds(ctx, bizTag, n)
+	encoder := this.config(bizTag).encoder
+	strs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		str, encErr := encoder.Encode(id)
+		if encErr != nil {
+			return strs, encErr
+		}
+		strs = append(strs, str)
+	}
+	return strs, err
+}
+
+// HasFilter reports whether any id filter is configured for bizTag. Without
+// filters the ids of a segment are consecutive.
+func (this *IdGenerator) HasFilter(bizTag string) bool {
+	return len(this.config(bizTag).filters) > 0
+}
+
+// config returns the settings of bizTag.
+func (this *IdGenerator) config(bizTag string) *bizTagConfig {
+	if conf, ok := this.bizTagConfs[bizTag]; ok {
+		return conf
+	}
+	return this.defaultConf
+}
+
+// preloadFunc returns the function used by the allocator to fetch the next
+// segment, with the retry policy of the bizTag. ctx is the lifetime of the
+// allocator.
+func (this *IdGenerator) preloadFunc(idAlloc *idAllocator) preloadFunc {
+	return func(ctx context.Context, bizTag string) (*Seg, error) {
+		conf := this.config(bizTag)
+
+		dynamicStore, dynamic := this.store.(DynamicStepStore)
+		dynamic = dynamic && conf.stepDuration > 0
+
+		// The step is decided once, the retries ask for the same segment.
+		step := conf.step
+		if dynamic {
+			step = idAlloc.nextStep(conf.stepDuration, conf.minStep, MaxStep)
+		}
+
+		var seg *Seg
+		err := conf.retryPolicy().do(ctx, func(ctx context.Context) error {
+			var err error
+			if dynamic {
+				seg, err = dynamicStore.GetNextSegmentWithStep(ctx, bizTag, step)
+			} else {
+				seg, err = this.store.GetNextSegment(ctx, bizTag, step)
+			}
+			if err != nil {
+				return err
+			}
+			if err = seg.check(); err != nil {
+				return err
+			}
+			seg, err = this.aboveWatermark(ctx, seg)
+			return err
+		})
+		if err != nil {
+			return nil, storeError(bizTag, err)
+		}
+		return seg, nil
+	}
+}
+
+// filter runs id of bizTag through all filters in order.
+func (this *bizTagConfig) filter(bizTag string, id int64) (int64, error) {
 	for _, f := range this.filters {
-		id, err = f(id)
+		next, err := f(id)
 		if err != nil {
 			filterName := runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
-			return 0, fmt.Errorf("id filter failed. func[%s], id[%d]", filterName, id)
+			return 0, &FilterError{BizTag: bizTag, Filter: filterName, Id: id, Err: err}
 		}
+		id = next
 	}
-	return id, err
-
+	return id, nil
 }
 
+// AddBizTag creates the id allocator of bizTag with a segment from the store
+// and adds it to the cache. Concurrent calls for the same bizTag share one
+// initialization: the segment is fetched once, with the retry policy of the
+// bizTag rather than ctx, so that a cancelled caller does not fail the
+// others. Each caller waits for it until its own ctx is done.
 func (this *IdGenerator) AddBizTag(ctx context.Context, bizTag string) (*idAllocator, error) {
-	// FIXME When concurrent add occurs, the creation and initialization will be repeated.
+	this.initMutex.Lock()
+	// It may have been added since the caller looked it up.
+	if idAlloc := this.cache.get(bizTag); idAlloc != nil {
+		this.initMutex.Unlock()
+		return idAlloc, nil
+	}
+	call, ok := this.initCalls[bizTag]
+	if !ok {
+		call = &bizTagCall{done: make(chan struct{})}
+		this.initCalls[bizTag] = call
+		go this.initBizTag(bizTag, call)
+	}
+	this.initMutex.Unlock()
 
-	seg, err := this.store.GetNextSegment(ctx, bizTag, this.step)
-	if err != nil {
-		return nil, err
+	select {
+	case <-call.done:
+		return call.idAlloc, call.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("[%s]wait biztag init %w: %w", bizTag, ErrTimeout, ctx.Err())
 	}
+}
+
+// RemoveBizTag drops the allocator of bizTag from the cache, the ids left in
+// its segments are not handed out. The next request fetches a new segment
+// from the store, which makes a change of the bizTag through an AdminStore
+// take effect at once. It reports whether bizTag was cached.
+func (this *IdGenerator) RemoveBizTag(bizTag string) bool {
+	return this.cache.remove(bizTag)
+}
+
+// bizTagCall is an in-flight initialization of a bizTag.
+type bizTagCall struct {
+	done    chan struct{} // Closed when idAlloc and err are set
+	idAlloc *idAllocator
+	err     error
+}
+
+func (this *IdGenerator) initBizTag(bizTag string, call *bizTagCall) {
+	conf := this.config(bizTag)
 
 	// Create and initialize
 	idAlloc := NewidAllocator(bizTag)
-	idAlloc.Init(seg)
-	this.cache.add(idAlloc)
-	idAlloc.update()
+	idAlloc.waitTimeout = this.waitTimeout
+	idAlloc.lockFree = conf.lockFree
+	idAlloc.prefetch = conf.prefetch
+	idAlloc.preloadRatio = conf.preloadRatio
+	idAlloc.preloadTime = conf.preloadTime
+	idAlloc.refuseDelay = conf.preloadMaxBackoff
+	idAlloc.backoff = conf.retryPolicy()
+	idAlloc.load = this.preloadFunc(idAlloc)
+	idAlloc.observer = this.observers
+
+	start := time.Now()
+	var seg *Seg
+	err := conf.retryPolicy().do(context.Background(), func(ctx context.Context) error {
+		var err error
+		seg, err = this.store.GetNextSegment(ctx, bizTag, conf.step)
+		if err != nil {
+			return err
+		}
+		if err = seg.check(); err != nil {
+			return err
+		}
+		seg, err = this.aboveWatermark(ctx, seg)
+		return err
+	})
+	if err != nil {
+		err = storeError(bizTag, err)
+	}
+	idAlloc.observeLoad(seg, err, time.Since(start))
+	if err == nil {
+		idAlloc.Init(seg)
+		idAlloc.update()
+	} else {
+		idAlloc.close()
+		idAlloc = nil
+	}
+
+	this.initMutex.Lock()
+	defer this.initMutex.Unlock()
+
+	// Add to the cache before removing the call, so that later callers find it.
+	if idAlloc != nil {
+		this.cache.add(idAlloc)
+	}
+	delete(this.initCalls, bizTag)
 
-	return idAlloc, nil
+	call.idAlloc, call.err = idAlloc, err
+	close(call.done)
 }
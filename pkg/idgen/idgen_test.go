@@ -39,6 +39,19 @@ func (s *storeDemo) GetNextSegment(ctx context.Context, bizTag string, step int6
 	}, nil
 }
 
+// storeDynamicDemo records the steps requested through GetNextSegmentWithStep
+type storeDynamicDemo struct {
+	storeDemo
+	steps []int64
+}
+
+func (s *storeDynamicDemo) GetNextSegmentWithStep(ctx context.Context, bizTag string, step int64) (*Seg, error) {
+	s.lock.Lock()
+	s.steps = append(s.steps, step)
+	s.lock.Unlock()
+	return s.GetNextSegment(ctx, bizTag, step)
+}
+
 type storeFastDemo struct {
 	max int64
 }
@@ -53,6 +66,19 @@ func (s *storeFastDemo) GetNextSegment(ctx context.Context, bizTag string, step
 	}, nil
 }
 
+// storeSlowDemo counts the fetched segments and takes delay to answer
+type storeSlowDemo struct {
+	storeDemo
+	delay time.Duration
+	calls int64
+}
+
+func (s *storeSlowDemo) GetNextSegment(ctx context.Context, bizTag string, step int64) (*Seg, error) {
+	atomic.AddInt64(&s.calls, 1)
+	time.Sleep(s.delay)
+	return s.storeDemo.GetNextSegment(ctx, bizTag, step)
+}
+
 func TestWithExpireTime(t *testing.T) {
 	assert := assert.New(t)
 
@@ -144,6 +170,231 @@ func TestWithStep(t *testing.T) {
 	}
 }
 
+func TestWithAdaptiveStep(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storeDynamicDemo{}
+	idGen := NewIdGenrator(&store, WithStep(100), WithAdaptiveStep(time.Hour, 0))
+	assert.Equal(int64(100), idGen.config("test").minStep, "min step should default to step")
+
+	// Segments are used up far faster than an hour, the step keeps doubling.
+	for i := 0; i < 2000; i++ {
+		_, err := idGen.GetId(context.Background(), "test")
+		assert.Nil(err, "get id err")
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	assert.NotEmpty(store.steps, "dynamic step not used")
+	for i, step := range store.steps {
+		assert.Equal(int64(200)<<i, step, "step not doubled, steps: %v", store.steps)
+	}
+}
+
+// storeFlakyDemo fails the calls after the first one until fails of them failed
+type storeFlakyDemo struct {
+	storeDemo
+	fails int64
+	calls int64
+}
+
+func (s *storeFlakyDemo) GetNextSegment(ctx context.Context, bizTag string, step int64) (*Seg, error) {
+	if n := atomic.AddInt64(&s.calls, 1); n > 1 && n <= s.fails+1 {
+		return nil, fmt.Errorf("store unavailable")
+	}
+	return s.storeDemo.GetNextSegment(ctx, bizTag, step)
+}
+
+func TestWithPreloadBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	// Each segment has one id, the preload of the second one fails twice.
+	store := storeFlakyDemo{fails: 2}
+	idGen := NewIdGenrator(&store, WithStep(3), WithPreloadRetryTimes(2),
+		WithPreloadBackoff(20*time.Millisecond, 30*time.Millisecond))
+	assert.Equal(20*time.Millisecond, idGen.config("test").preloadBackoff, "backoff err")
+	assert.Equal(30*time.Millisecond, idGen.config("test").preloadMaxBackoff, "max backoff err")
+
+	_, err := idGen.GetId(context.Background(), "test")
+	assert.Nil(err, "get id err")
+
+	// Backoffs of at least 10ms and 15ms before the third attempt succeeds.
+	start := time.Now()
+	id, err := idGen.GetId(context.Background(), "test")
+	assert.Nil(err, "get id after retries err")
+	assert.Equal(int64(4), id, "id err")
+	assert.GreaterOrEqual(time.Since(start), 25*time.Millisecond, "no backoff")
+	assert.Equal(int64(4), atomic.LoadInt64(&store.calls), "calls err")
+
+	// The retry budget is used up, the preload gives up.
+	store = storeFlakyDemo{fails: 1000}
+	idGen = NewIdGenrator(&store, WithStep(3), WithPreloadRetryTimes(2), WithWaitTimeout(200*time.Millisecond),
+		WithPreloadBackoff(time.Millisecond, time.Millisecond))
+	_, err = idGen.GetId(context.Background(), "test")
+	assert.Nil(err, "get id err")
+	_, err = idGen.GetId(context.Background(), "test")
+	assert.ErrorIs(err, ErrWaitTimeout, "not a wait timeout")
+}
+
+func TestWithPreloadBackoff_failedPreloads(t *testing.T) {
+	assert := assert.New(t)
+
+	// test: the backoff spans the failed preloads, a waiting request does
+	// not start the next one at once even without retries. The backoffs of
+	// at least 5, 10, 20, 40, 80 and 160ms fit in 500ms.
+	for _, lockFree := range []bool{false, true} {
+		store := storeFlakyDemo{fails: 1 << 30}
+		opts := []Option{WithStep(3), WithPreloadRetryTimes(0), WithWaitTimeout(500 * time.Millisecond),
+			WithPreloadBackoff(10*time.Millisecond, time.Second)}
+		if lockFree {
+			opts = append(opts, WithLockFree())
+		}
+		idGen := NewIdGenrator(&store, opts...)
+		_, err := idGen.GetId(context.Background(), "test")
+		assert.Nil(err, "get id err")
+		_, err = idGen.GetId(context.Background(), "test")
+		assert.ErrorIs(err, ErrWaitTimeout, "not a wait timeout")
+		assert.LessOrEqual(atomic.LoadInt64(&store.calls), int64(1+7), "store calls, lockFree %v", lockFree)
+	}
+}
+
+func TestWithWaitTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	// Each segment has one id, the second GetId waits for the slow preload.
+	store := storeSlowDemo{delay: 500 * time.Millisecond}
+	idGen := NewIdGenrator(&store, WithStep(3), WithWaitTimeout(50*time.Millisecond))
+
+	_, err := idGen.GetId(context.Background(), "test")
+	assert.Nil(err, "get id err")
+
+	start := time.Now()
+	_, err = idGen.GetId(context.Background(), "test")
+	assert.ErrorIs(err, ErrWaitTimeout, "not a wait timeout")
+	assert.ErrorIs(err, context.DeadlineExceeded, "ctx err not wrapped")
+	assert.Less(time.Since(start), 400*time.Millisecond, "wait timeout not applied")
+
+	// A deadline of the request takes the place of the wait timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err = idGen.GetId(ctx, "deadline")
+	assert.Nil(err, "get id err")
+	_, err = idGen.GetId(ctx, "deadline")
+	assert.Nil(err, "get id with deadline err")
+}
+
+func TestWithPreloadTime(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storeDemo{}
+	idGen := NewIdGenrator(&store, WithStep(1000), WithPreloadRatio(0.99),
+		WithBizTagConfig("slow", WithBizTagPreloadTime(100*time.Millisecond)))
+
+	assert.Equal(0.99, idGen.config("test").preloadRatio, "preload ratio err")
+	assert.Equal(time.Duration(0), idGen.config("test").preloadTime, "preload time err")
+	assert.Equal(100*time.Millisecond, idGen.config("slow").preloadTime, "biztag preload time err")
+
+	// 20 ids used in more than 20ms, the 978 ids left last far longer than 100ms.
+	for i := 0; i < 20; i++ {
+		for _, bizTag := range []string{"test", "slow"} {
+			_, err := idGen.GetId(context.Background(), bizTag)
+			assert.Nil(err, "get id err")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	assert.Equal(int64(2000), store.maxs["test"], "ratio should preload")
+	assert.Equal(int64(1000), store.maxs["slow"], "preload time should not preload yet")
+}
+
+func TestWithBizTagConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storeDynamicDemo{}
+	idGen := NewIdGenrator(&store,
+		WithStep(100),
+		With2BytesRandomFilter(),
+		WithBizTagConfig("order",
+			WithBizTagStep(500),
+			WithBizTagIdFilter(nil),
+			WithBizTagIdEncoder(NewCrockford32Encoder()),
+			WithBizTagPreloadRetryTimes(5),
+		),
+		WithBizTagConfig("user", WithBizTagAdaptiveStep(time.Hour, 0)),
+	)
+
+	tests := []struct {
+		name      string
+		bizTag    string
+		step      int64
+		hasFilter bool
+		retry     int
+	}{
+		{
+			name:      "override",
+			bizTag:    "order",
+			step:      500,
+			hasFilter: false,
+			retry:     5,
+		},
+		{
+			name:      "partial override",
+			bizTag:    "user",
+			step:      100,
+			hasFilter: true,
+			retry:     DefaultRetry,
+		},
+		{
+			name:      "unlisted",
+			bizTag:    "other",
+			step:      100,
+			hasFilter: true,
+			retry:     DefaultRetry,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := idGen.config(tt.bizTag)
+			assert.Equal(tt.step, conf.step, "step err")
+			assert.Equal(tt.hasFilter, idGen.HasFilter(tt.bizTag), "filter err")
+			assert.Equal(tt.retry, conf.preloadRetryTimes, "retry times err")
+			assert.Equal(DefaultPreloadTimeout, conf.preloadTimeout, "preload timeout should fall back to default")
+
+			_, err := idGen.GetId(context.Background(), tt.bizTag)
+			assert.Nil(err, "get id err")
+			store.lock.Lock()
+			assert.Equal(tt.step, store.maxs[tt.bizTag], "segment step err")
+			store.lock.Unlock()
+		})
+	}
+
+	// Only "user" has the adaptive step. 20 ids trigger the preload of both.
+	for i := 0; i < 20; i++ {
+		_, err := idGen.GetId(context.Background(), "other")
+		assert.Nil(err, "get id err")
+		_, err = idGen.GetId(context.Background(), "user")
+		assert.Nil(err, "get id err")
+	}
+	time.Sleep(10 * time.Millisecond)
+	store.lock.Lock()
+	assert.Equal([]int64{200}, store.steps, "adaptive step should apply to user only")
+	assert.Equal(int64(200), store.maxs["other"], "other should keep the default step")
+	store.lock.Unlock()
+
+	// The ids of "order" are consecutive and encoded in base32.
+	id, err := idGen.GetIdString(context.Background(), "order")
+	assert.Nil(err, "get id string err")
+	assert.Equal("2", id, "encoder err")
+	id, err = idGen.GetIdString(context.Background(), "other")
+	assert.Nil(err, "get id string err")
+	_, err = DecimalEncoder{}.Decode(id)
+	assert.Nil(err, "default encoder should be decimal")
+}
+
 func TestIdGenerator_GetId(t *testing.T) {
 	assert := assert.New(t)
 
@@ -190,6 +441,143 @@ func TestIdGenerator_GetId(t *testing.T) {
 	wg.Wait()
 }
 
+func TestWithLockFree(t *testing.T) {
+	assert := assert.New(t)
+	var res sync.Map
+
+	var goroutines int = 20
+	var timesPerGoroutine int = 2000
+
+	store := storeDemo{}
+	idGen := NewIdGenrator(&store, WithStep(1000), WithLockFree(),
+		WithBizTagConfig("lock", WithBizTagLockFree(false)))
+
+	for _, bizTag := range []string{"test", "lock"} {
+		id, err := idGen.GetId(context.Background(), bizTag)
+		assert.Nil(err, "get id err")
+		res.Store(bizTag+fmt.Sprint(id), 1)
+	}
+	assert.True(idGen.cache.get("test").lockFree, "lock free not set")
+	assert.False(idGen.cache.get("lock").lockFree, "lock free not overridden")
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < timesPerGoroutine; j++ {
+				var ids []int64
+				var err error
+				if j%10 == 0 {
+					ids, err = idGen.GetIds(context.Background(), "test", 10)
+				} else {
+					var id int64
+					id, err = idGen.GetId(context.Background(), "test")
+					ids = []int64{id}
+				}
+				assert.Nil(err, "get id err")
+
+				for _, id := range ids {
+					_, loaded := res.LoadOrStore("test"+fmt.Sprint(id), 1)
+					assert.False(loaded, "id duplication: %d", id)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestIdGenerator_AddBizTag(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storeSlowDemo{delay: 100 * time.Millisecond}
+	idGen := NewIdGenrator(&store, WithStep(10000))
+
+	var goroutines = 100
+	var res sync.Map
+	var errs int64
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := idGen.GetId(context.Background(), "test")
+			if err != nil {
+				atomic.AddInt64(&errs, 1)
+				return
+			}
+			_, loaded := res.LoadOrStore(id, 1)
+			assert.False(loaded, "id duplication: %d", id)
+		}()
+	}
+
+	// A caller with a short deadline gives up without failing the others.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := idGen.GetId(ctx, "test")
+	assert.ErrorIs(err, context.DeadlineExceeded, "short deadline should be respected")
+
+	wg.Wait()
+
+	assert.Equal(int64(0), errs, "concurrent init failed")
+	assert.Equal(int64(1), atomic.LoadInt64(&store.calls), "segment fetched more than once")
+	assert.Empty(idGen.initCalls, "init call not removed")
+
+	idAlloc := idGen.cache.get("test")
+	assert.NotNil(idAlloc, "biztag not in cache")
+	again, err := idGen.AddBizTag(context.Background(), "test")
+	assert.Nil(err, "add cached biztag err")
+	assert.Same(idAlloc, again, "cached allocator replaced")
+}
+
+func TestIdGenerator_GetIds(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storeDemo{}
+	idGen := NewIdGenrator(&store, WithStep(1000))
+
+	var res sync.Map
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				ids, err := idGen.GetIds(context.Background(), "test", 250)
+				assert.Nil(err, "get ids err")
+				assert.Equal(250, len(ids), "ids num err")
+				for _, id := range ids {
+					_, loaded := res.LoadOrStore(id, 1)
+					assert.Equal(false, loaded, "id duplication: %d", id)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, err := idGen.GetIds(context.Background(), "test", 0)
+	assert.ErrorIs(err, ErrInvalidCount, "zero count should fail")
+	_, err = idGen.GetIds(context.Background(), "test", math.MaxInt64-1000)
+	assert.ErrorIs(err, ErrInvalidCount, "huge count should fail")
+	_, err = idGen.GetIds(context.Background(), "test", MaxIdCount+1)
+	assert.ErrorIs(err, ErrInvalidCount, "count above MaxIdCount should fail")
+
+	// test: a filter failure returns the ids filtered before it
+	calls := 0
+	failAfter3 := func(id int64) (int64, error) {
+		calls++
+		if calls > 3 {
+			return 0, fmt.Errorf("filter err")
+		}
+		return id, nil
+	}
+	idGen = NewIdGenrator(&store, WithIdFilter([]IdFilter{failAfter3}))
+	ids, err := idGen.GetIds(context.Background(), "test", 10)
+	assert.NotNil(err, "filter err not returned")
+	assert.Equal(3, len(ids), "partial ids num err")
+}
+
 func BenchmarkGetId(b *testing.B) {
 	store := storeFastDemo{}
 	var step int64 = MaxStep
@@ -202,3 +590,49 @@ func BenchmarkGetId(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkGetIdParallel(b *testing.B) {
+	benchmarkGetIdParallel(b, NewIdGenrator(&storeFastDemo{}, WithStep(MaxStep)))
+}
+
+func BenchmarkGetIdLockFree(b *testing.B) {
+	store := storeFastDemo{}
+	idGen := NewIdGenrator(&store, WithStep(MaxStep), WithLockFree())
+	ctx := context.Background()
+	for n := 0; n < b.N; n++ {
+		_, err := idGen.GetId(ctx, "test")
+		if err != nil {
+			b.Errorf("get id err: %s", err)
+		}
+	}
+}
+
+func BenchmarkGetIdLockFreeParallel(b *testing.B) {
+	benchmarkGetIdParallel(b, NewIdGenrator(&storeFastDemo{}, WithStep(MaxStep), WithLockFree()))
+}
+
+// benchmarkGetIdParallel gets ids of one bizTag from GOMAXPROCS goroutines.
+func benchmarkGetIdParallel(b *testing.B, idGen *IdGenerator) {
+	ctx := context.Background()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, err := idGen.GetId(ctx, "test")
+			if err != nil {
+				b.Errorf("get id err: %s", err)
+			}
+		}
+	})
+}
+
+func BenchmarkGetIds(b *testing.B) {
+	store := storeFastDemo{}
+	var step int64 = MaxStep
+	idGen := NewIdGenrator(&store, WithStep(step))
+	ctx := context.Background()
+	for n := 0; n < b.N; n++ {
+		_, err := idGen.GetIds(ctx, "test", 100)
+		if err != nil {
+			b.Errorf("get ids err: %s", err)
+		}
+	}
+}
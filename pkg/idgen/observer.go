@@ -0,0 +1,98 @@
+package idgen
+
+import (
+	"fmt"
+	"time"
+)
+
+type EventType int
+
+const (
+	EventSegmentFetched    EventType = iota + 1 // A segment was fetched from the store
+	EventPreloadFailed                          // A preload failed to fetch a segment, after the retries
+	EventSegmentSwitched                        // The allocator moved on to the next segment
+	EventWaitTimeout                            // A request waiting for the next segment gave up
+	EventBizTagEvicted                          // An unused bizTag was removed from the cache, see WithExpireTime
+	EventWatermarkViolated                      // A segment from the store was not above the high water mark, see WithWatermark
+)
+
+func (this EventType) String() string {
+	switch this {
+	case EventSegmentFetched:
+		return "segment_fetched"
+	case EventPreloadFailed:
+		return "preload_failed"
+	case EventSegmentSwitched:
+		return "segment_switched"
+	case EventWaitTimeout:
+		return "wait_timeout"
+	case EventBizTagEvicted:
+		return "biztag_evicted"
+	case EventWatermarkViolated:
+		return "watermark_violated"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(this))
+	}
+}
+
+// Event is a lifecycle event of the allocator of a bizTag.
+type Event struct {
+	Type   EventType
+	BizTag string
+
+	// The segment (MinId, MaxId] the event is about: the segment fetched,
+	// the one switched to, the one in use when the request gave up or the
+	// bizTag was evicted, the one below the mark. Both are 0 when there is none.
+	MinId int64
+	MaxId int64
+
+	// Latency of the event:
+	//  - EventSegmentFetched, EventPreloadFailed: time taken by the fetch, retries included
+	//  - EventSegmentSwitched: time the previous segment was in use
+	//  - EventWaitTimeout: time the request waited
+	//  - EventBizTagEvicted: time the bizTag was unused
+	Latency time.Duration
+
+	Err error // The error of EventPreloadFailed and EventWaitTimeout, the violation of EventWatermarkViolated
+}
+
+// Observer receives the events of the allocators. It is called synchronously,
+// sometimes with the lock of the allocator held, so it should return quickly
+// and must not call the IdGenerator.
+type Observer interface {
+	Observe(e Event)
+}
+
+// ObserverFunc is an Observer function.
+type ObserverFunc func(e Event)
+
+func (this ObserverFunc) Observe(e Event) {
+	this(e)
+}
+
+// WithObserver registers an observer of the allocator events, the observers
+// are called in the order they are registered.
+func WithObserver(observer Observer) Option {
+	return func(idgen *IdGenerator) {
+		idgen.observers = append(idgen.observers, observer)
+	}
+}
+
+// observers calls each of its observers.
+type observers []Observer
+
+func (this observers) Observe(e Event) {
+	for _, o := range this {
+		o.Observe(e)
+	}
+}
+
+// segmentEvent returns an event about seg.
+func segmentEvent(typ EventType, bizTag string, seg *idSegment) Event {
+	e := Event{Type: typ, BizTag: bizTag}
+	if seg != nil && seg.isInit {
+		e.MinId = seg.Min
+		e.MaxId = seg.Max + 1
+	}
+	return e
+}
@@ -0,0 +1,162 @@
+package idgen
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eventRecorder records the events of the given types
+type eventRecorder struct {
+	lock   sync.Mutex
+	types  map[EventType]bool
+	events []Event
+}
+
+func newEventRecorder(types ...EventType) *eventRecorder {
+	r := &eventRecorder{types: make(map[EventType]bool)}
+	for _, typ := range types {
+		r.types[typ] = true
+	}
+	return r
+}
+
+func (r *eventRecorder) Observe(e Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.types[e.Type] {
+		r.events = append(r.events, e)
+	}
+}
+
+func (r *eventRecorder) get() []Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+func TestWithObserver(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, lockFree := range []bool{false, true} {
+		fetched := newEventRecorder(EventSegmentFetched)
+		switched := newEventRecorder(EventSegmentSwitched)
+		opts := []Option{WithStep(3), WithObserver(fetched), WithObserver(switched)}
+		if lockFree {
+			opts = append(opts, WithLockFree())
+		}
+		idGen := NewIdGenrator(&storeDemo{}, opts...)
+
+		// Each segment has one id, the second GetId switches to the preloaded segment.
+		start := time.Now()
+		for i := 0; i < 2; i++ {
+			_, err := idGen.GetId(context.Background(), "test")
+			assert.Nil(err, "get id err")
+		}
+		elapsed := time.Since(start)
+
+		events := fetched.get()
+		if assert.GreaterOrEqual(len(events), 2, "lockFree %v", lockFree) {
+			assert.Equal(Event{Type: EventSegmentFetched, BizTag: "test", MinId: 0, MaxId: 3, Latency: events[0].Latency}, events[0])
+			assert.Equal(Event{Type: EventSegmentFetched, BizTag: "test", MinId: 3, MaxId: 6, Latency: events[1].Latency}, events[1])
+		}
+		events = switched.get()
+		if assert.Len(events, 1, "lockFree %v", lockFree) {
+			assert.Equal("test", events[0].BizTag)
+			assert.Equal(int64(3), events[0].MinId)
+			assert.Equal(int64(6), events[0].MaxId)
+			assert.LessOrEqual(events[0].Latency, elapsed, "the first segment was in use at most the whole time")
+		}
+	}
+}
+
+func TestWithObserver_failure(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, lockFree := range []bool{false, true} {
+		failed := newEventRecorder(EventPreloadFailed)
+		timeout := newEventRecorder(EventWaitTimeout)
+		opts := []Option{WithStep(3), WithWaitTimeout(50 * time.Millisecond),
+			WithPreloadBackoff(time.Millisecond, time.Millisecond), WithObserver(failed), WithObserver(timeout)}
+		if lockFree {
+			opts = append(opts, WithLockFree())
+		}
+		idGen := NewIdGenrator(&storeFlakyDemo{fails: 1000}, opts...)
+
+		_, err := idGen.GetId(context.Background(), "test")
+		assert.Nil(err, "get id err")
+		_, err = idGen.GetId(context.Background(), "test")
+		assert.ErrorIs(err, ErrWaitTimeout, "not a wait timeout")
+
+		// The preload may still be retrying when the request gives up.
+		assert.Eventually(func() bool { return len(failed.get()) > 0 }, time.Second, 10*time.Millisecond, "lockFree %v", lockFree)
+		events := failed.get()
+		if assert.NotEmpty(events, "lockFree %v", lockFree) {
+			assert.Equal("test", events[0].BizTag)
+			assert.ErrorIs(events[0].Err, ErrStoreUnavailable)
+		}
+		events = timeout.get()
+		if assert.Len(events, 1, "lockFree %v", lockFree) {
+			assert.Equal("test", events[0].BizTag)
+			assert.Equal(int64(0), events[0].MinId, "the used up segment")
+			assert.Equal(int64(3), events[0].MaxId, "the used up segment")
+			assert.GreaterOrEqual(events[0].Latency, 50*time.Millisecond, "wait time")
+			assert.Equal(err, events[0].Err)
+		}
+	}
+}
+
+func TestWithObserver_evicted(t *testing.T) {
+	assert := assert.New(t)
+
+	evicted := newEventRecorder(EventBizTagEvicted)
+	idGen := NewIdGenrator(&storeDemo{}, WithExpireTime(20*time.Millisecond), WithObserver(evicted))
+	_, err := idGen.GetId(context.Background(), "test")
+	assert.Nil(err, "get id err")
+
+	assert.Eventually(func() bool { return len(evicted.get()) > 0 }, time.Second, 10*time.Millisecond, "not evicted")
+	events := evicted.get()
+	assert.Equal("test", events[0].BizTag)
+	assert.Equal(int64(DefaultStep), events[0].MaxId)
+	assert.Greater(events[0].Latency, 20*time.Millisecond, "idle time")
+}
+
+func TestWithObserver_closed(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, lockFree := range []bool{false, true} {
+		events := newEventRecorder(EventSegmentFetched, EventPreloadFailed)
+		started := make(chan struct{}, 1)
+		idAlloc := NewidAllocator("test")
+		idAlloc.lockFree = lockFree
+		idAlloc.observer = events
+		idAlloc.load = func(ctx context.Context, bizTag string) (*Seg, error) {
+			started <- struct{}{}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		idAlloc.Init(&Seg{BizTag: "test", MaxId: 4, Step: 4})
+
+		// test: the preload cancelled by the close, e.g. of an evicted
+		// bizTag, is not a failure. The segment has two ids, the second
+		// starts the preload.
+		for i := 0; i < 2; i++ {
+			_, err := idAlloc.NextId(context.Background())
+			assert.Nil(err, "lockFree %v", lockFree)
+		}
+		<-started
+		idAlloc.close()
+		time.Sleep(20 * time.Millisecond)
+		assert.Empty(events.get(), "lockFree %v", lockFree)
+	}
+}
+
+func TestEventType_String(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("segment_fetched", EventSegmentFetched.String())
+	assert.Equal("biztag_evicted", EventBizTagEvicted.String())
+	assert.Equal("EventType(0)", EventType(0).String())
+}
@@ -0,0 +1,67 @@
+package idgen
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// retryPolicy is how a segment is fetched from the store. Each attempt is
+// bounded by timeout, a failed attempt is retried up to retries times, after
+// a backoff doubled at each retry from backoff to maxBackoff. The backoff is
+// jittered, so that the allocators which failed together do not retry together.
+type retryPolicy struct {
+	retries    int
+	timeout    time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// do runs f until it succeeds or the retries are used up, and returns the
+// last error. It gives up as soon as ctx is done, including during a backoff,
+// and when the store refuses the bizTag.
+func (this retryPolicy) do(ctx context.Context, f func(ctx context.Context) error) error {
+	var err error
+	for i := 0; i <= this.retries; i++ {
+		if i > 0 {
+			t := time.NewTimer(this.delay(i))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			}
+		}
+
+		err = this.try(ctx, f)
+		if err == nil || ctx.Err() != nil || refused(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (this retryPolicy) try(ctx context.Context, f func(ctx context.Context) error) error {
+	if this.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, this.timeout)
+		defer cancel()
+	}
+	return f(ctx)
+}
+
+// delay returns the backoff before the nth retry, in [d/2, d] where d is
+// backoff * 2^(n-1) capped by maxBackoff.
+func (this retryPolicy) delay(n int) time.Duration {
+	d := this.backoff
+	for i := 1; i < n && d < this.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > this.maxBackoff {
+		d = this.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,135 @@
+package idgen
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_retryPolicy_do(t *testing.T) {
+	assert := assert.New(t)
+
+	policy := retryPolicy{
+		retries:    3,
+		timeout:    time.Second,
+		backoff:    10 * time.Millisecond,
+		maxBackoff: 20 * time.Millisecond,
+	}
+	errStore := errors.New("store err")
+
+	tests := []struct {
+		name      string
+		fails     int // Number of attempts failing before one succeeds
+		wantCalls int
+		wantErr   error
+	}{
+		{
+			name:      "test. succ at first",
+			fails:     0,
+			wantCalls: 1,
+		},
+		{
+			name:      "test. succ after retries",
+			fails:     3,
+			wantCalls: 4,
+		},
+		{
+			name:      "test. retries used up",
+			fails:     10,
+			wantCalls: 4,
+			wantErr:   errStore,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			start := time.Now()
+			err := policy.do(context.Background(), func(ctx context.Context) error {
+				_, ok := ctx.Deadline()
+				assert.True(ok, "attempt should have a deadline")
+				calls++
+				if calls <= tt.fails {
+					return errStore
+				}
+				return nil
+			})
+			assert.Equal(tt.wantErr, err, "err")
+			assert.Equal(tt.wantCalls, calls, "calls")
+
+			// The backoffs are at least 5ms, 10ms, 10ms.
+			minWait := []time.Duration{0, 5, 15, 25}[tt.wantCalls-1] * time.Millisecond
+			assert.GreaterOrEqual(time.Since(start), minWait, "backoff")
+		})
+	}
+}
+
+func Test_retryPolicy_do_cancel(t *testing.T) {
+	assert := assert.New(t)
+
+	policy := retryPolicy{retries: 3, backoff: time.Minute, maxBackoff: time.Minute}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	calls := 0
+	start := time.Now()
+	err := policy.do(ctx, func(ctx context.Context) error {
+		calls++
+		return errors.New("store err")
+	})
+	assert.ErrorIs(err, context.Canceled)
+	assert.Equal(1, calls, "should not retry after cancel")
+	assert.Less(time.Since(start), time.Second, "should not wait for the backoff")
+}
+
+func Test_retryPolicy_delay(t *testing.T) {
+	policy := retryPolicy{backoff: 100 * time.Millisecond, maxBackoff: time.Second}
+
+	tests := []struct {
+		n    int
+		want time.Duration // Delay before jitter
+	}{
+		{n: 1, want: 100 * time.Millisecond},
+		{n: 2, want: 200 * time.Millisecond},
+		{n: 4, want: 800 * time.Millisecond},
+		{n: 5, want: time.Second},
+		{n: 100, want: time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			got := policy.delay(tt.n)
+			if got < tt.want/2 || got > tt.want {
+				t.Fatalf("retryPolicy.delay(%d) = %v, want in [%v, %v]", tt.n, got, tt.want/2, tt.want)
+			}
+		}
+	}
+}
+
+func Test_idAllocator_close(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, lockFree := range []bool{false, true} {
+		loads := 0
+		idAlloc := NewidAllocator("test")
+		idAlloc.lockFree = lockFree
+		idAlloc.load = func(ctx context.Context, bizTag string) (*Seg, error) {
+			loads++
+			return &Seg{BizTag: "test", MaxId: 4, Step: 2}, nil
+		}
+		idAlloc.Init(&Seg{BizTag: "test", MaxId: 3, Step: 3})
+		idAlloc.close()
+
+		// The segment has one id, the next request waits for a preload
+		// which a closed allocator does not start.
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		id, err := idAlloc.NextId(ctx)
+		assert.Nil(err, "lockFree %v", lockFree)
+		assert.Equal(int64(1), id, "lockFree %v", lockFree)
+		_, err = idAlloc.NextId(ctx)
+		cancel()
+		assert.ErrorIs(err, ErrWaitTimeout, "lockFree %v", lockFree)
+		assert.Equal(0, loads, "lockFree %v", lockFree)
+	}
+}
@@ -0,0 +1,235 @@
+package idgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSnowflakeTimeBits   = 41                   // about 69 years in milliseconds
+	DefaultSnowflakeWorkerBits = 10                   // 1024 workers
+	DefaultSnowflakeSeqBits    = 12                   // 4096 ids per millisecond per worker
+	DefaultMaxClockBackward    = 5 * time.Millisecond // default clock drift that is waited out instead of failing
+)
+
+// DefaultSnowflakeEpoch is the default custom epoch, 2024-01-01 00:00:00 UTC.
+var DefaultSnowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var ErrClockBackwards = errors.New("clock moved backwards")
+
+// SnowflakeGenerator generates time ordered ids without any store.
+/*
+			+--------------------------------------+
+			|0|000......000|00....00|000......000|
+			+--------------------------------------+
+1bit reserved   timestamp    worker id    sequence
+				(ms since epoch)
+*/
+// The bit width of each part is configurable, they add up to at most 63 bits.
+// The bizTag does not take part in the id, all bizTags share one sequence.
+type SnowflakeGenerator struct {
+	mutex sync.Mutex
+
+	epoch      time.Time
+	timeBits   uint
+	workerBits uint
+	seqBits    uint
+
+	workerId int64
+	lastTime int64 // Milliseconds since epoch of the last id
+	sequence int64 // Sequence of the last id in lastTime
+
+	// When the clock moves backwards by no more than maxBackward, generation
+	// waits for the clock to catch up, otherwise ErrClockBackwards is returned.
+	maxBackward time.Duration
+
+	// When set, generation stops while the lease of workerId is not valid.
+	lease WorkerLease
+
+	now func() time.Time
+}
+
+type SnowflakeOption func(*SnowflakeGenerator)
+
+// WithSnowflakeLayout sets the bit width of timestamp, worker id and sequence.
+func WithSnowflakeLayout(timeBits, workerBits, seqBits uint) SnowflakeOption {
+	return func(sf *SnowflakeGenerator) {
+		sf.timeBits = timeBits
+		sf.workerBits = workerBits
+		sf.seqBits = seqBits
+	}
+}
+
+// WithSnowflakeEpoch sets the custom epoch the timestamp is counted from.
+func WithSnowflakeEpoch(epoch time.Time) SnowflakeOption {
+	return func(sf *SnowflakeGenerator) {
+		sf.epoch = epoch
+	}
+}
+
+// WithMaxClockBackward sets how far the clock may move backwards before
+// generation fails with ErrClockBackwards. Within it, generation waits.
+func WithMaxClockBackward(d time.Duration) SnowflakeOption {
+	if d < 0 {
+		d = 0
+	}
+	return func(sf *SnowflakeGenerator) {
+		sf.maxBackward = d
+	}
+}
+
+// WithWorkerLease makes the generator refuse to generate ids while the lease
+// of its worker id is not valid, see RedisWorkerLease.
+func WithWorkerLease(lease WorkerLease) SnowflakeOption {
+	return func(sf *SnowflakeGenerator) {
+		sf.lease = lease
+	}
+}
+
+func NewSnowflakeGenerator(workerId int64, opts ...SnowflakeOption) (*SnowflakeGenerator, error) {
+	sf := &SnowflakeGenerator{
+		epoch:       DefaultSnowflakeEpoch,
+		timeBits:    DefaultSnowflakeTimeBits,
+		workerBits:  DefaultSnowflakeWorkerBits,
+		seqBits:     DefaultSnowflakeSeqBits,
+		workerId:    workerId,
+		lastTime:    -1,
+		maxBackward: DefaultMaxClockBackward,
+		now:         time.Now,
+	}
+
+	for _, o := range opts {
+		o(sf)
+	}
+
+	if sf.timeBits == 0 || sf.seqBits == 0 || sf.timeBits+sf.workerBits+sf.seqBits > 63 {
+		return nil, fmt.Errorf("invalid snowflake layout, time bits: %d, worker bits: %d, seq bits: %d",
+			sf.timeBits, sf.workerBits, sf.seqBits)
+	}
+	if workerId < 0 || workerId >= 1<<sf.workerBits {
+		return nil, fmt.Errorf("invalid snowflake worker id %d, should be in [0, %d)", workerId, int64(1)<<sf.workerBits)
+	}
+	// A lease over other worker ids than the layout, e.g. RedisWorkerLease,
+	// does not keep the worker ids of the instances apart.
+	if lease, ok := sf.lease.(interface{ MaxWorkers() int64 }); ok && lease.MaxWorkers() != 1<<sf.workerBits {
+		return nil, fmt.Errorf("snowflake worker id lease over %d worker ids, should be %d", lease.MaxWorkers(), int64(1)<<sf.workerBits)
+	}
+	if sf.now().Before(sf.epoch) {
+		return nil, fmt.Errorf("snowflake epoch %v is in the future", sf.epoch)
+	}
+
+	return sf, nil
+}
+
+func (this *SnowflakeGenerator) GetId(ctx context.Context, bizTag string) (int64, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.nextId(ctx)
+}
+
+// GetIds generates n ids in order. On failure the ids generated so far are
+// returned along with the error, like IdGenerator.GetIds.
+func (this *SnowflakeGenerator) GetIds(ctx context.Context, bizTag string, n int) ([]int64, error) {
+	if err := checkIdCount(n); err != nil {
+		return nil, err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	var ids []int64
+	for len(ids) < n {
+		id, err := this.nextId(ctx)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Parse splits an id into its time, worker id and sequence.
+func (this *SnowflakeGenerator) Parse(id int64) (t time.Time, workerId int64, seq int64) {
+	seq = id & (1<<this.seqBits - 1)
+	workerId = (id >> this.seqBits) & (1<<this.workerBits - 1)
+	ms := id >> (this.seqBits + this.workerBits)
+	t = this.epoch.Add(time.Duration(ms) * time.Millisecond)
+	return t, workerId, seq
+}
+
+// nextId generates an id, the caller must hold the lock.
+func (this *SnowflakeGenerator) nextId(ctx context.Context) (int64, error) {
+	if this.lease != nil {
+		if err := this.lease.Valid(); err != nil {
+			return 0, err
+		}
+	}
+
+	now, err := this.currentTime(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// The state is only updated once the id is generated, so that a failed
+	// call does not hand out the sequence again.
+	var sequence int64
+	if now == this.lastTime {
+		sequence = (this.sequence + 1) & (1<<this.seqBits - 1)
+		if sequence == 0 {
+			// The sequence of this millisecond is used up, wait for the next one.
+			now, err = this.waitUntil(ctx, this.lastTime+1)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if now >= 1<<this.timeBits {
+		return 0, fmt.Errorf("snowflake timestamp overflow, epoch: %v", this.epoch)
+	}
+
+	this.lastTime = now
+	this.sequence = sequence
+	return now<<(this.workerBits+this.seqBits) | this.workerId<<this.seqBits | this.sequence, nil
+}
+
+// currentTime returns the milliseconds since epoch, never less than lastTime.
+// A clock moved backwards within maxBackward is waited out.
+func (this *SnowflakeGenerator) currentTime(ctx context.Context) (int64, error) {
+	now := this.millis()
+	if now >= this.lastTime {
+		return now, nil
+	}
+
+	backward := time.Duration(this.lastTime-now) * time.Millisecond
+	if backward > this.maxBackward {
+		return 0, fmt.Errorf("%w by %v", ErrClockBackwards, backward)
+	}
+	return this.waitUntil(ctx, this.lastTime)
+}
+
+// waitUntil waits until the clock reaches the millisecond target, it fails
+// with ErrTimeout when ctx is done first.
+func (this *SnowflakeGenerator) waitUntil(ctx context.Context, target int64) (int64, error) {
+	for {
+		now := this.millis()
+		if now >= target {
+			return now, nil
+		}
+
+		timer := time.NewTimer(time.Duration(target-now) * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, fmt.Errorf("%w, wait for the clock %w", ErrTimeout, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+func (this *SnowflakeGenerator) millis() int64 {
+	return this.now().Sub(this.epoch).Milliseconds()
+}
@@ -0,0 +1,210 @@
+package idgen
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock returns the times in order, then keeps advancing by 1ms per call.
+type fakeClock struct {
+	lock  sync.Mutex
+	times []time.Time
+	last  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.times) > 0 {
+		c.last = c.times[0]
+		c.times = c.times[1:]
+		return c.last
+	}
+	c.last = c.last.Add(time.Millisecond)
+	return c.last
+}
+
+func TestNewSnowflakeGenerator(t *testing.T) {
+	tests := []struct {
+		name     string
+		workerId int64
+		opts     []SnowflakeOption
+		wantErr  bool
+	}{
+		{
+			name:     "default",
+			workerId: 1,
+		},
+		{
+			name:     "custom layout",
+			workerId: 31,
+			opts:     []SnowflakeOption{WithSnowflakeLayout(40, 5, 18)},
+		},
+		{
+			name:     "layout beyond 63 bits",
+			workerId: 1,
+			opts:     []SnowflakeOption{WithSnowflakeLayout(42, 10, 12)},
+			wantErr:  true,
+		},
+		{
+			name:     "no sequence bits",
+			workerId: 1,
+			opts:     []SnowflakeOption{WithSnowflakeLayout(41, 10, 0)},
+			wantErr:  true,
+		},
+		{
+			name:     "worker id too large",
+			workerId: 32,
+			opts:     []SnowflakeOption{WithSnowflakeLayout(40, 5, 18)},
+			wantErr:  true,
+		},
+		{
+			name:     "negative worker id",
+			workerId: -1,
+			wantErr:  true,
+		},
+		{
+			name:     "epoch in the future",
+			workerId: 1,
+			opts:     []SnowflakeOption{WithSnowflakeEpoch(time.Now().Add(time.Hour))},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSnowflakeGenerator(tt.workerId, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewSnowflakeGenerator() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSnowflakeGenerator_GetId(t *testing.T) {
+	assert := assert.New(t)
+
+	sf, err := NewSnowflakeGenerator(7)
+	assert.Nil(err, "new snowflake generator err")
+
+	var res sync.Map
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last int64
+			for j := 0; j < 5000; j++ {
+				id, err := sf.GetId(context.Background(), "test")
+				assert.Nil(err, "get id err")
+				assert.Greater(id, last, "id not increasing")
+				last = id
+
+				_, loaded := res.LoadOrStore(id, 1)
+				assert.Equal(false, loaded, "id duplication: %d", id)
+			}
+		}()
+	}
+	wg.Wait()
+
+	id, _ := sf.GetId(context.Background(), "test")
+	ts, workerId, _ := sf.Parse(id)
+	assert.Equal(int64(7), workerId, "parsed worker id")
+	assert.WithinDuration(time.Now(), ts, time.Second, "parsed time")
+}
+
+func TestSnowflakeGenerator_GetIds(t *testing.T) {
+	assert := assert.New(t)
+
+	// 2 bits of sequence, 4 ids per millisecond
+	sf, err := NewSnowflakeGenerator(1, WithSnowflakeLayout(41, 10, 2))
+	assert.Nil(err, "new snowflake generator err")
+
+	ids, err := sf.GetIds(context.Background(), "test", 100)
+	assert.Nil(err, "get ids err")
+	assert.Equal(100, len(ids), "ids num err")
+	for i := 1; i < len(ids); i++ {
+		assert.Greater(ids[i], ids[i-1], "ids not increasing")
+	}
+
+	_, err = sf.GetIds(context.Background(), "test", 0)
+	assert.ErrorIs(err, ErrInvalidCount, "zero count should fail")
+	_, err = sf.GetIds(context.Background(), "test", MaxIdCount+1)
+	assert.ErrorIs(err, ErrInvalidCount, "count above MaxIdCount should fail")
+}
+
+func TestSnowflakeGenerator_SequenceWrapCancel(t *testing.T) {
+	assert := assert.New(t)
+	var lock sync.Mutex
+	now := time.Now()
+	clock := func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		return now
+	}
+
+	// 2 bits of sequence, 4 ids per millisecond
+	sf, err := NewSnowflakeGenerator(1, WithSnowflakeLayout(41, 10, 2))
+	assert.Nil(err, "new snowflake generator err")
+	sf.now = clock
+
+	seen := make(map[int64]bool)
+	ids, err := sf.GetIds(context.Background(), "test", 4)
+	assert.Nil(err, "get ids err")
+	for _, id := range ids {
+		seen[id] = true
+	}
+
+	// test: the sequence of the millisecond is used up and the ctx is done,
+	// the failed calls must not hand out its sequence again
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		_, err = sf.GetId(ctx, "test")
+		assert.ErrorIs(err, context.Canceled)
+		assert.ErrorIs(err, ErrTimeout)
+	}
+
+	lock.Lock()
+	now = now.Add(time.Millisecond)
+	lock.Unlock()
+	ids, err = sf.GetIds(context.Background(), "test", 4)
+	assert.Nil(err, "get ids err")
+	for _, id := range ids {
+		assert.False(seen[id], "id duplication: %d", id)
+		seen[id] = true
+	}
+	_, _, seq := sf.Parse(ids[0])
+	assert.Equal(int64(0), seq, "the next millisecond starts over")
+}
+
+func TestSnowflakeGenerator_ClockBackwards(t *testing.T) {
+	assert := assert.New(t)
+	base := time.Now()
+
+	// test: a small step back is waited out
+	clock := &fakeClock{times: []time.Time{base, base.Add(-3 * time.Millisecond)}}
+	sf, err := NewSnowflakeGenerator(1, WithMaxClockBackward(5*time.Millisecond))
+	assert.Nil(err, "new snowflake generator err")
+	sf.now = clock.now
+
+	first, err := sf.GetId(context.Background(), "test")
+	assert.Nil(err, "get id err")
+	second, err := sf.GetId(context.Background(), "test")
+	assert.Nil(err, "small clock backwards should be waited out")
+	assert.Greater(second, first, "id not increasing after clock backwards")
+
+	// test: a large step back fails
+	clock = &fakeClock{times: []time.Time{base, base.Add(-time.Second)}}
+	sf, _ = NewSnowflakeGenerator(1, WithMaxClockBackward(5*time.Millisecond))
+	sf.now = clock.now
+
+	_, err = sf.GetId(context.Background(), "test")
+	assert.Nil(err, "get id err")
+	_, err = sf.GetId(context.Background(), "test")
+	assert.True(errors.Is(err, ErrClockBackwards), "large clock backwards err: %v", err)
+}
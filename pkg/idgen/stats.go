@@ -0,0 +1,98 @@
+package idgen
+
+import (
+	"sort"
+	"time"
+)
+
+// BizTagStats is a snapshot of the allocator of a bizTag.
+type BizTagStats struct {
+	BizTag        string `json:"biztag"`
+	Remaining     int64  `json:"remaining"`      // Ids left in the segment in use
+	NextRemaining int64  `json:"next_remaining"` // Ids in the preloaded segments
+	Step          int64  `json:"step"`           // Step of the last segment fetched
+	LockFree      bool   `json:"lock_free"`
+
+	// The segment buffers and the index of the one in use. In lock free mode
+	// the segment in use comes first, followed by the preloaded ones.
+	CurrentPos int64          `json:"current_pos"`
+	Segments   []SegmentStats `json:"segments"`
+
+	IsPreload  bool      `json:"is_preload"`            // A preload is running
+	PreloadErr string    `json:"preload_err,omitempty"` // Error of the last preload, empty when it succeeded
+	Waiting    int       `json:"waiting"`               // Requests waiting for the next segment
+	UpdateTime time.Time `json:"update_time"`           // Time the bizTag was last used
+}
+
+// SegmentStats is a snapshot of a segment buffer, the ids (Cur, Max) are left.
+type SegmentStats struct {
+	Min    int64 `json:"min"`
+	Cur    int64 `json:"cur"`
+	Max    int64 `json:"max"`
+	IsInit bool  `json:"is_init"`
+}
+
+// Stats returns a snapshot of the allocators of the cached bizTags, sorted
+// by bizTag.
+func (this *IdGenerator) Stats() []BizTagStats {
+	stats := make([]BizTagStats, 0)
+	this.cache.cache.Range(func(key, value interface{}) bool {
+		stats = append(stats, value.(*idAllocator).stats())
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].BizTag < stats[j].BizTag
+	})
+	return stats
+}
+
+// StatsOf returns a snapshot of the allocator of bizTag, false when bizTag
+// is not cached.
+func (this *IdGenerator) StatsOf(bizTag string) (BizTagStats, bool) {
+	idAlloc := this.cache.get(bizTag)
+	if idAlloc == nil {
+		return BizTagStats{}, false
+	}
+	return idAlloc.stats(), true
+}
+
+func (this *idAllocator) stats() BizTagStats {
+	this.Lock()
+	defer this.Unlock()
+
+	stats := BizTagStats{
+		BizTag:     this.Key,
+		Step:       this.Step,
+		LockFree:   this.lockFree,
+		UpdateTime: this.lastUpdate(),
+	}
+	if this.preloadErr != nil {
+		stats.PreloadErr = this.preloadErr.Error()
+	}
+
+	if this.lockFree {
+		queue := this.queue.Load()
+		stats.Remaining = queue.cur.remaining()
+		stats.Segments = append(stats.Segments, queue.cur.stats())
+		for _, seg := range queue.next {
+			stats.NextRemaining += seg.remaining()
+			stats.Segments = append(stats.Segments, seg.stats())
+		}
+		stats.IsPreload = this.preloading.Load()
+		stats.Waiting = int(this.waiters.Load())
+		return stats
+	}
+
+	stats.Remaining = this.getSegment().remaining()
+	n := int64(len(this.Buffer))
+	for i := int64(1); i < n; i++ {
+		stats.NextRemaining += this.Buffer[(this.currentPos+i)%n].remaining()
+	}
+	for _, seg := range this.Buffer {
+		stats.Segments = append(stats.Segments, seg.stats())
+	}
+	stats.CurrentPos = this.currentPos
+	stats.IsPreload = this.IsPreload
+	stats.Waiting = len(this.Waiting)
+	return stats
+}
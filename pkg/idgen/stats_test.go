@@ -0,0 +1,94 @@
+package idgen
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdGenerator_Stats(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, lockFree := range []bool{false, true} {
+		opts := []Option{WithStep(100)}
+		if lockFree {
+			opts = append(opts, WithLockFree())
+		}
+		idGen := NewIdGenrator(&storeDemo{}, opts...)
+		assert.Empty(idGen.Stats(), "no biztag yet")
+		_, ok := idGen.StatsOf("a")
+		assert.False(ok, "no biztag yet")
+
+		// The segment (0, 100] serves 98 ids, the 11th starts the preload.
+		start := time.Now()
+		for _, bizTag := range []string{"b", "a"} {
+			for i := 0; i < 11; i++ {
+				_, err := idGen.GetId(context.Background(), bizTag)
+				assert.Nil(err, "get id err")
+			}
+		}
+
+		assert.Eventually(func() bool {
+			stats := idGen.Stats()
+			return len(stats) == 2 && stats[0].NextRemaining > 0 && stats[1].NextRemaining > 0
+		}, time.Second, time.Millisecond, "not preloaded, lockFree %v", lockFree)
+
+		stats := idGen.Stats()
+		assert.Equal("a", stats[0].BizTag, "sorted by biztag")
+		assert.Equal("b", stats[1].BizTag, "sorted by biztag")
+
+		a, ok := idGen.StatsOf("a")
+		assert.True(ok, "biztag cached")
+		assert.Equal(stats[0], a)
+		assert.Equal(int64(87), a.Remaining, "lockFree %v", lockFree)
+		assert.Equal(int64(98), a.NextRemaining, "lockFree %v", lockFree)
+		assert.Equal(int64(100), a.Step)
+		assert.Equal(lockFree, a.LockFree)
+		assert.Equal(int64(0), a.CurrentPos)
+		assert.Equal([]SegmentStats{
+			{Min: 0, Cur: 11, Max: 99, IsInit: true},
+			{Min: 100, Cur: 100, Max: 199, IsInit: true},
+		}, a.Segments, "lockFree %v", lockFree)
+		assert.False(a.IsPreload)
+		assert.Empty(a.PreloadErr)
+		assert.Equal(0, a.Waiting)
+		assert.False(a.UpdateTime.Before(start), "update time")
+	}
+}
+
+func TestIdGenerator_Stats_waiting(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, lockFree := range []bool{false, true} {
+		opts := []Option{WithStep(3), WithPreloadBackoff(time.Millisecond, time.Millisecond)}
+		if lockFree {
+			opts = append(opts, WithLockFree())
+		}
+		idGen := NewIdGenrator(&storeFlakyDemo{fails: 1000}, opts...)
+		_, err := idGen.GetId(context.Background(), "test")
+		assert.Nil(err, "get id err")
+
+		// The store is down, the request waits for the next segment.
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		done := make(chan struct{})
+		go func() {
+			idGen.GetId(ctx, "test")
+			close(done)
+		}()
+
+		assert.Eventually(func() bool {
+			stats, _ := idGen.StatsOf("test")
+			return stats.Waiting == 1 && stats.PreloadErr != ""
+		}, time.Second, time.Millisecond, "not waiting, lockFree %v", lockFree)
+		stats, _ := idGen.StatsOf("test")
+		assert.Equal(int64(0), stats.Remaining)
+		assert.Contains(stats.PreloadErr, ErrStoreUnavailable.Error())
+
+		cancel()
+		<-done
+		stats, _ = idGen.StatsOf("test")
+		assert.Equal(0, stats.Waiting, "lockFree %v", lockFree)
+	}
+}
@@ -2,14 +2,65 @@ package idgen
 
 import (
 	"context"
+	"fmt"
 )
 
+// Seg is a segment of ids (MaxId-Step, MaxId] returned by the store. Step must
+// be the step the store actually used, the allocator derives the lower bound
+// of the segment from it.
 type Seg struct {
 	BizTag string
 	MaxId  int64
 	Step   int64
 }
 
+func (this *Seg) check() error {
+	if this.Step <= 0 || this.MaxId < this.Step {
+		return fmt.Errorf("[%s]invalid seg, max id: %d, step: %d", this.BizTag, this.MaxId, this.Step)
+	}
+	return nil
+}
+
 type IdStore interface {
 	GetNextSegment(ctx context.Context, bizTag string, step int64) (*Seg, error)
 }
+
+// DynamicStepStore is implemented by stores that can advance a bizTag by a
+// step chosen by the caller instead of the step stored for it. It is required
+// by the adaptive step of IdGenerator.
+type DynamicStepStore interface {
+	GetNextSegmentWithStep(ctx context.Context, bizTag string, step int64) (*Seg, error)
+}
+
+// BizTagInfo is the state of a bizTag in the store.
+type BizTagInfo struct {
+	BizTag   string `json:"biztag"`
+	MaxId    int64  `json:"max_id"` // The last id handed out in a segment
+	Step     int64  `json:"step"`
+	Disabled bool   `json:"disabled"`
+}
+
+// AdminStore is implemented by stores whose bizTags can be managed
+// explicitly. The changes take effect on the next segment fetched, the
+// IdGenerators which cached the bizTag serve the ids they hold until then,
+// see IdGenerator.RemoveBizTag.
+type AdminStore interface {
+	// CreateBizTag creates bizTag, its first segment starts after start.
+	// It fails with ErrBizTagExists if bizTag exists or was archived.
+	CreateBizTag(ctx context.Context, bizTag string, start int64, step int64) error
+	// GetBizTag returns the state of bizTag, or ErrUnknownBizTag.
+	GetBizTag(ctx context.Context, bizTag string) (*BizTagInfo, error)
+	// SetStep changes the step of the next segments of bizTag. With the
+	// adaptive step (WithAdaptiveStep) the step is the floor of the adapted
+	// step, which grows from it and shrinks back down to it.
+	SetStep(ctx context.Context, bizTag string, step int64) error
+	// SetDisabled disables or enables bizTag, the segments of a disabled
+	// bizTag are refused with ErrBizTagDisabled.
+	SetDisabled(ctx context.Context, bizTag string, disabled bool) error
+	// ArchiveBizTag retires bizTag and keeps its state aside, the segments
+	// are refused with ErrBizTagArchived and the bizTag cannot be created again.
+	ArchiveBizTag(ctx context.Context, bizTag string) error
+	// DeleteBizTag removes bizTag, archived or not. A bizTag created again
+	// afterwards hands out the ids it handed out before.
+	DeleteBizTag(ctx context.Context, bizTag string) error
+}
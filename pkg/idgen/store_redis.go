@@ -2,26 +2,46 @@ package idgen
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/go-redis/redis/v8"
 )
 
+// getSegScript advances the max of the bizTag and returns {newMax, step},
+// the step is the one actually used to advance max. A new bizTag is created
+// when ARGV[3] is 1, unless it was archived. A step pinned by SetStep is the
+// floor of the custom step ARGV[2].
 var getSegScript = `
 local key = KEYS[1]
-local step = ARGV[1]
+local archiveKey = KEYS[2]
+local step = tonumber(ARGV[1])
+local customStep = tonumber(ARGV[2])
+local create = ARGV[3]
 
 local exists = redis.call("EXISTS", key)
 
 if exists == 1 then
+	if redis.call("HGET", key, "disabled") == "1" then
+		return redis.error_reply("IDGEN_DISABLED")
+	end
 	local max = redis.call("HGET", key, "max")
-	local currentStep = redis.call("HGET", key, "step")
-	local newMax = tonumber(max) + tonumber(currentStep)
+	local currentStep = tonumber(redis.call("HGET", key, "step"))
+	if customStep ~= nil and customStep > 0 then
+		if redis.call("HGET", key, "pinned") ~= "1" or customStep > currentStep then
+			currentStep = customStep
+		end
+	end
+	local newMax = tonumber(max) + currentStep
 	redis.call("HSET", key, "max", newMax)
-	return newMax
+	return {newMax, currentStep}
+elseif redis.call("EXISTS", archiveKey) == 1 then
+	return redis.error_reply("IDGEN_ARCHIVED")
+elseif create ~= "1" then
+	return redis.error_reply("IDGEN_UNKNOWN")
 else
 	redis.call("HSET", key, "step", step)
 	redis.call("HSET", key, "max", step)
-	return step
+	return {step, step}
 end
 `
 
@@ -29,33 +49,98 @@ var getSegLua = redis.NewScript(getSegScript)
 
 type RedisIdStore struct {
 	redisClient *redis.Client
+
+	strict    bool                // Only the bizTags in allowlist are created implicitly
+	allowlist map[string]struct{} // See WithStrictBizTags
+
+	failover *failover // See WithFailoverBump, nil when off
+}
+
+type RedisStoreOption func(*RedisIdStore)
+
+// WithStrictBizTags turns off the implicit creation of the bizTags, except
+// for those in allowlist. The segments of the other bizTags are refused with
+// ErrUnknownBizTag until they are created through AdminStore.CreateBizTag,
+// so that a misspelt bizTag does not start a new sequence.
+func WithStrictBizTags(allowlist ...string) RedisStoreOption {
+	return func(store *RedisIdStore) {
+		store.strict = true
+		store.allowlist = make(map[string]struct{}, len(allowlist))
+		for _, bizTag := range allowlist {
+			store.allowlist[bizTag] = struct{}{}
+		}
+	}
 }
 
-func NewRedisIdStore(client *redis.Client) *RedisIdStore {
-	return &RedisIdStore{
+func NewRedisIdStore(client *redis.Client, opts ...RedisStoreOption) *RedisIdStore {
+	store := &RedisIdStore{
 		redisClient: client,
 	}
+	for _, opt := range opts {
+		opt(store)
+	}
+	return store
 }
 
 func (this *RedisIdStore) GetNextSegment(ctx context.Context, bizTag string, step int64) (*Seg, error) {
-	// If there is no key in redis, it is created; otherwise, it is updated
-	newMaxId, err := this.getNextMaxId(ctx, bizTag, step)
+	// If there is no key in redis, it is created unless strict; otherwise, it is updated
+	return this.getNextSeg(ctx, bizTag, step, 0)
+}
+
+// GetNextSegmentWithStep advances bizTag by step, ignoring the step stored in
+// redis unless it was set by SetStep: the step set by the admin is the floor.
+func (this *RedisIdStore) GetNextSegmentWithStep(ctx context.Context, bizTag string, step int64) (*Seg, error) {
+	return this.getNextSeg(ctx, bizTag, step, step)
+}
+
+func (this *RedisIdStore) genRedisKey(bizTag string) string {
+	return "idgen:" + bizTag
+}
+
+// genArchiveKey returns the key an archived bizTag is renamed to.
+func (this *RedisIdStore) genArchiveKey(bizTag string) string {
+	return "idgen-archive:" + bizTag
+}
+
+// getNextSeg runs getSegScript. The step of the returned Seg is the one the
+// script used, which may differ from the requested step when the bizTag
+// already exists in redis with another step.
+func (this *RedisIdStore) getNextSeg(ctx context.Context, bizTag string, step int64, customStep int64) (*Seg, error) {
+	if this.failover != nil {
+		return this.getNextSegChecked(ctx, bizTag, step, customStep)
+	}
+	return this.getSeg(ctx, this.redisClient, bizTag, step, customStep)
+}
+
+func (this *RedisIdStore) getSeg(ctx context.Context, c redis.Scripter, bizTag string, step int64, customStep int64) (*Seg, error) {
+	return segResult(bizTag, getSegLua.Run(ctx, c, this.keys(bizTag), step, customStep, this.creatable(bizTag)))
+}
+
+// segResult returns the Seg of bizTag from the reply of getSegScript.
+func segResult(bizTag string, cmd *redis.Cmd) (*Seg, error) {
+	res, err := cmd.Int64Slice()
 	if err != nil {
-		return nil, err
+		return nil, scriptError(bizTag, err)
+	}
+	if len(res) != 2 {
+		return nil, fmt.Errorf("[%s]unexpected get seg script result: %v", bizTag, res)
 	}
+
 	return &Seg{
 		BizTag: bizTag,
-		MaxId:  newMaxId,
-		Step:   step,
+		MaxId:  res[0],
+		Step:   res[1],
 	}, nil
 }
 
-func (this *RedisIdStore) genRedisKey(bizTag string) string {
-	return "idgen:" + bizTag
-}
-
-func (this *RedisIdStore) getNextMaxId(ctx context.Context, bizTag string, step int64) (int64, error) {
-	keys := []string{this.genRedisKey(bizTag)}
-	res, err := getSegLua.Run(ctx, this.redisClient, keys, step).Int64()
-	return res, err
+// creatable returns 1 when bizTag may be created implicitly, the create
+// argument of getSegScript.
+func (this *RedisIdStore) creatable(bizTag string) int {
+	if !this.strict {
+		return 1
+	}
+	if _, ok := this.allowlist[bizTag]; ok {
+		return 1
+	}
+	return 0
 }
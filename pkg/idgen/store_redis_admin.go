@@ -0,0 +1,155 @@
+package idgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The error replies of the scripts, turned into errors by scriptError. Some
+// servers prefix them with ERR.
+const (
+	replyUnknown  = "IDGEN_UNKNOWN"
+	replyExists   = "IDGEN_EXISTS"
+	replyDisabled = "IDGEN_DISABLED"
+	replyArchived = "IDGEN_ARCHIVED"
+)
+
+// createLua creates the bizTag with max ARGV[1] and step ARGV[2].
+var createLua = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 or redis.call("EXISTS", KEYS[2]) == 1 then
+	return redis.error_reply("IDGEN_EXISTS")
+end
+redis.call("HSET", KEYS[1], "max", ARGV[1], "step", ARGV[2])
+return 1
+`)
+
+// setFieldLua sets the fields ARGV[1], ARGV[3]... of an existing bizTag to
+// ARGV[2], ARGV[4]...
+var setFieldLua = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return redis.error_reply("IDGEN_UNKNOWN")
+end
+redis.call("HSET", KEYS[1], unpack(ARGV))
+return 1
+`)
+
+// archiveLua renames the bizTag to its archive key.
+var archiveLua = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	if redis.call("EXISTS", KEYS[2]) == 1 then
+		return redis.error_reply("IDGEN_ARCHIVED")
+	end
+	return redis.error_reply("IDGEN_UNKNOWN")
+end
+redis.call("RENAME", KEYS[1], KEYS[2])
+return 1
+`)
+
+// scriptError turns the error replies of the scripts into the errors of bizTag.
+func scriptError(bizTag string, err error) error {
+	var reply redis.Error
+	if !errors.As(err, &reply) {
+		return err
+	}
+	switch msg := reply.Error(); {
+	case strings.Contains(msg, replyUnknown):
+		return fmt.Errorf("[%s]%w", bizTag, ErrUnknownBizTag)
+	case strings.Contains(msg, replyExists):
+		return fmt.Errorf("[%s]%w", bizTag, ErrBizTagExists)
+	case strings.Contains(msg, replyDisabled):
+		return fmt.Errorf("[%s]%w", bizTag, ErrBizTagDisabled)
+	case strings.Contains(msg, replyArchived):
+		return fmt.Errorf("[%s]%w", bizTag, ErrBizTagArchived)
+	default:
+		return err
+	}
+}
+
+func (this *RedisIdStore) keys(bizTag string) []string {
+	return []string{this.genRedisKey(bizTag), this.genArchiveKey(bizTag)}
+}
+
+// CreateBizTag creates bizTag, the first segment is (start, start+step].
+func (this *RedisIdStore) CreateBizTag(ctx context.Context, bizTag string, start int64, step int64) error {
+	if start < 0 || step <= 0 {
+		return fmt.Errorf("[%s]invalid start %d or step %d", bizTag, start, step)
+	}
+	err := createLua.Run(ctx, this.redisClient, this.keys(bizTag), start, step).Err()
+	return scriptError(bizTag, err)
+}
+
+func (this *RedisIdStore) GetBizTag(ctx context.Context, bizTag string) (*BizTagInfo, error) {
+	var info struct {
+		Max      int64 `redis:"max"`
+		Step     int64 `redis:"step"`
+		Disabled bool  `redis:"disabled"`
+	}
+	res := this.redisClient.HGetAll(ctx, this.genRedisKey(bizTag))
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+	if len(res.Val()) == 0 {
+		archived, err := this.redisClient.Exists(ctx, this.genArchiveKey(bizTag)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if archived == 1 {
+			return nil, fmt.Errorf("[%s]%w", bizTag, ErrBizTagArchived)
+		}
+		return nil, fmt.Errorf("[%s]%w", bizTag, ErrUnknownBizTag)
+	}
+	if err := res.Scan(&info); err != nil {
+		return nil, fmt.Errorf("[%s]invalid biztag hash: %w", bizTag, err)
+	}
+	return &BizTagInfo{
+		BizTag:   bizTag,
+		MaxId:    info.Max,
+		Step:     info.Step,
+		Disabled: info.Disabled,
+	}, nil
+}
+
+// SetStep sets the step of bizTag and pins it: GetNextSegmentWithStep, used
+// by the adaptive step of IdGenerator, then advances bizTag by at least step.
+func (this *RedisIdStore) SetStep(ctx context.Context, bizTag string, step int64) error {
+	if step <= 0 {
+		return fmt.Errorf("[%s]invalid step %d", bizTag, step)
+	}
+	return this.setField(ctx, bizTag, "step", step, "pinned", 1)
+}
+
+func (this *RedisIdStore) SetDisabled(ctx context.Context, bizTag string, disabled bool) error {
+	value := 0
+	if disabled {
+		value = 1
+	}
+	return this.setField(ctx, bizTag, "disabled", value)
+}
+
+// setField sets the fields of an existing bizTag, fieldValues are the field
+// and value pairs.
+func (this *RedisIdStore) setField(ctx context.Context, bizTag string, fieldValues ...interface{}) error {
+	err := setFieldLua.Run(ctx, this.redisClient, this.keys(bizTag)[:1], fieldValues...).Err()
+	return scriptError(bizTag, err)
+}
+
+// ArchiveBizTag renames the hash of bizTag to idgen-archive:<bizTag>.
+func (this *RedisIdStore) ArchiveBizTag(ctx context.Context, bizTag string) error {
+	err := archiveLua.Run(ctx, this.redisClient, this.keys(bizTag)).Err()
+	return scriptError(bizTag, err)
+}
+
+func (this *RedisIdStore) DeleteBizTag(ctx context.Context, bizTag string) error {
+	n, err := this.redisClient.Del(ctx, this.keys(bizTag)...).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("[%s]%w", bizTag, ErrUnknownBizTag)
+	}
+	return nil
+}
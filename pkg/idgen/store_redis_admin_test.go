@@ -0,0 +1,233 @@
+package idgen
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisIdStore_CreateBizTag(t *testing.T) {
+	assert := assert.New(t)
+	mr, client := newTestRedisClient(t)
+	store := NewRedisIdStore(client)
+	ctx := context.Background()
+
+	err := store.CreateBizTag(ctx, "test", 1000, 50)
+	assert.Nil(err, "create err")
+	info, err := store.GetBizTag(ctx, "test")
+	assert.Nil(err, "get biztag err")
+	assert.Equal(&BizTagInfo{BizTag: "test", MaxId: 1000, Step: 50}, info)
+
+	// test: the first segment starts after start, with the created step
+	seg, err := store.GetNextSegment(ctx, "test", 100)
+	assert.Nil(err, "get seg err")
+	assert.Equal(int64(1050), seg.MaxId)
+	assert.Equal(int64(50), seg.Step)
+
+	err = store.CreateBizTag(ctx, "test", 0, 50)
+	assert.ErrorIs(err, ErrBizTagExists)
+	assert.Equal("1050", mr.HGet("idgen:test", "max"), "existing biztag should not be reset")
+
+	assert.NotNil(store.CreateBizTag(ctx, "bad", 0, 0), "step must be positive")
+	assert.NotNil(store.CreateBizTag(ctx, "bad", -1, 10), "start must not be negative")
+
+	_, err = store.GetBizTag(ctx, "none")
+	assert.ErrorIs(err, ErrUnknownBizTag)
+}
+
+func TestRedisIdStore_Admin(t *testing.T) {
+	assert := assert.New(t)
+	_, client := newTestRedisClient(t)
+	store := NewRedisIdStore(client)
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		admin   func() error
+		wantErr error
+		wantSeg *Seg  // The next segment, when segErr is nil
+		segErr  error // The error of the next segment
+	}{
+		{
+			name:    "test. set step",
+			admin:   func() error { return store.SetStep(ctx, "test", 200) },
+			wantSeg: &Seg{BizTag: "test", MaxId: 300, Step: 200},
+		},
+		{
+			name:   "test. disable",
+			admin:  func() error { return store.SetDisabled(ctx, "test", true) },
+			segErr: ErrBizTagDisabled,
+		},
+		{
+			name:    "test. enable",
+			admin:   func() error { return store.SetDisabled(ctx, "test", false) },
+			wantSeg: &Seg{BizTag: "test", MaxId: 500, Step: 200},
+		},
+		{
+			name:   "test. archive",
+			admin:  func() error { return store.ArchiveBizTag(ctx, "test") },
+			segErr: ErrBizTagArchived,
+		},
+		{
+			name:    "test. archived can not be created",
+			admin:   func() error { return store.CreateBizTag(ctx, "test", 0, 100) },
+			wantErr: ErrBizTagExists,
+			segErr:  ErrBizTagArchived,
+		},
+		{
+			name:    "test. archived can not be changed",
+			admin:   func() error { return store.SetStep(ctx, "test", 100) },
+			wantErr: ErrUnknownBizTag,
+			segErr:  ErrBizTagArchived,
+		},
+		{
+			name:    "test. delete archived",
+			admin:   func() error { return store.DeleteBizTag(ctx, "test") },
+			wantSeg: &Seg{BizTag: "test", MaxId: 100, Step: 100},
+		},
+		{
+			name:    "test. delete unknown",
+			admin:   func() error { return store.DeleteBizTag(ctx, "none") },
+			wantErr: ErrUnknownBizTag,
+			segErr:  nil,
+		},
+	}
+
+	_, err := store.GetNextSegment(ctx, "test", 100)
+	assert.Nil(err, "get seg err")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.admin()
+			if tt.wantErr != nil {
+				assert.ErrorIs(err, tt.wantErr)
+			} else {
+				assert.Nil(err, "admin err")
+			}
+			if tt.wantSeg == nil && tt.segErr == nil {
+				return
+			}
+
+			seg, err := store.GetNextSegment(ctx, "test", 100)
+			if tt.segErr != nil {
+				assert.ErrorIs(err, tt.segErr)
+			} else {
+				assert.Nil(err, "get seg err")
+				assert.Equal(tt.wantSeg, seg)
+			}
+		})
+	}
+}
+
+func TestRedisIdStore_SetStepPinned(t *testing.T) {
+	assert := assert.New(t)
+	_, client := newTestRedisClient(t)
+	store := NewRedisIdStore(client)
+	ctx := context.Background()
+
+	seg, err := store.GetNextSegment(ctx, "test", 100)
+	assert.Nil(err, "get seg err")
+	assert.Equal(int64(100), seg.MaxId)
+
+	// test: the custom step wins over the step stored by the first segment
+	seg, err = store.GetNextSegmentWithStep(ctx, "test", 50)
+	assert.Nil(err, "get seg err")
+	assert.Equal(&Seg{BizTag: "test", MaxId: 150, Step: 50}, seg)
+
+	// test: a step set by the admin is the floor of the custom step
+	assert.Nil(store.SetStep(ctx, "test", 200))
+	seg, err = store.GetNextSegmentWithStep(ctx, "test", 50)
+	assert.Nil(err, "get seg err")
+	assert.Equal(&Seg{BizTag: "test", MaxId: 350, Step: 200}, seg, "custom step below the pinned step")
+	seg, err = store.GetNextSegmentWithStep(ctx, "test", 400)
+	assert.Nil(err, "get seg err")
+	assert.Equal(&Seg{BizTag: "test", MaxId: 750, Step: 400}, seg, "custom step above the pinned step")
+}
+
+func TestIdGenerator_RemoveBizTag(t *testing.T) {
+	assert := assert.New(t)
+	_, client := newTestRedisClient(t)
+	store := NewRedisIdStore(client)
+	ctx := context.Background()
+
+	idGen := NewIdGenrator(store, WithStep(100), WithPreloadBackoff(time.Millisecond, time.Millisecond))
+	id, err := idGen.GetId(ctx, "test")
+	assert.Nil(err, "get id err")
+	assert.Equal(int64(1), id)
+
+	// The cached segment is served until the bizTag is removed.
+	assert.Nil(store.SetDisabled(ctx, "test", true))
+	_, err = idGen.GetId(ctx, "test")
+	assert.Nil(err, "cached segment")
+
+	assert.True(idGen.RemoveBizTag("test"))
+	assert.False(idGen.RemoveBizTag("test"), "already removed")
+	_, err = idGen.GetId(ctx, "test")
+	assert.ErrorIs(err, ErrBizTagDisabled)
+	assert.NotErrorIs(err, ErrStoreUnavailable, "a refused bizTag is not a store failure")
+
+	// The ids left in the removed segment are skipped.
+	assert.Nil(store.SetDisabled(ctx, "test", false))
+	id, err = idGen.GetId(ctx, "test")
+	assert.Nil(err, "get id err")
+	assert.Equal(int64(101), id)
+}
+
+// storeCountDemo counts the segments fetched from the redis store.
+type storeCountDemo struct {
+	*RedisIdStore
+	calls atomic.Int64
+}
+
+func (s *storeCountDemo) GetNextSegment(ctx context.Context, bizTag string, step int64) (*Seg, error) {
+	s.calls.Add(1)
+	return s.RedisIdStore.GetNextSegment(ctx, bizTag, step)
+}
+
+func TestIdGenerator_Disabled(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "locked"},
+		{name: "lock free", opts: []Option{WithLockFree()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			_, client := newTestRedisClient(t)
+			store := &storeCountDemo{RedisIdStore: NewRedisIdStore(client)}
+			ctx := context.Background()
+
+			opts := append([]Option{WithStep(10), WithWaitTimeout(time.Second)}, tt.opts...)
+			idGen := NewIdGenrator(store, opts...)
+			_, err := idGen.GetId(ctx, "test")
+			assert.Nil(err, "get id err")
+
+			// A cached bizTag disabled by another node is refused at once
+			// when its segments are used up, without hammering the store.
+			assert.Nil(store.SetDisabled(ctx, "test", true))
+			store.calls.Store(0)
+			start := time.Now()
+			for i := 0; i < 100; i++ {
+				_, err = idGen.GetId(ctx, "test")
+				if err != nil {
+					break
+				}
+			}
+			assert.ErrorIs(err, ErrBizTagDisabled)
+			assert.NotErrorIs(err, ErrTimeout, "should not wait for the preload")
+			for i := 0; i < 100; i++ {
+				_, err = idGen.GetId(ctx, "test")
+				assert.ErrorIs(err, ErrBizTagDisabled)
+			}
+			_, err = idGen.GetIds(ctx, "test", 5)
+			assert.ErrorIs(err, ErrBizTagDisabled)
+			assert.Less(time.Since(start), 500*time.Millisecond, "should fail fast")
+			assert.LessOrEqual(store.calls.Load(), int64(2), "store calls")
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package idgen
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// FailoverEvent is a change of the redis master seen by a RedisIdStore, and
+// the bump of its bizTags which followed.
+type FailoverEvent struct {
+	OldRunId string
+	NewRunId string
+	Bumped   map[string]int64 // The max of each bizTag after the bump
+	// Err is set when the run_id could not be read, e.g. INFO is denied by
+	// an ACL, NewRunId is empty and nothing is bumped. The fetch fails
+	// with this error.
+	Err error
+}
+
+// WithFailoverBump makes the store check the run_id of the redis server with
+// each segment it fetches. The run_id is read in the same pipeline as the
+// segment, so both come from the same server. When it changed, the master
+// failed over or restarted and may have lost the latest segments: the max of
+// every bizTag served by the store is raised by steps steps, above the max
+// last served, and the segment is fetched again. A segment whose run_id could
+// not be read, e.g. INFO is denied by an ACL, is not served and the fetch
+// fails. onFailover, if not nil, is called after the bump, and when the
+// run_id could not be read.
+//
+// Each store bumps its own bizTags, a bizTag served by several nodes is bumped
+// by each of them, see WithWatermark for the segments below the ids handed out.
+func WithFailoverBump(steps int64, onFailover func(FailoverEvent)) RedisStoreOption {
+	return func(store *RedisIdStore) {
+		store.failover = &failover{
+			steps:      steps,
+			onFailover: onFailover,
+			runId:      serverRunId,
+			bizTags:    make(map[string]Seg),
+		}
+	}
+}
+
+// failover is the state of WithFailoverBump.
+type failover struct {
+	steps      int64
+	onFailover func(FailoverEvent)
+	runId      func(ctx context.Context, pipe redis.Pipeliner) func() (string, error) // Queues the read of the run_id of the server in pipe
+
+	lock      sync.Mutex
+	lastRunId string         // Empty until the first check
+	bizTags   map[string]Seg // The last segment served of each bizTag
+
+	bumpLock sync.Mutex // Only one fetch bumps the bizTags, the others wait for it
+}
+
+// bumpLua raises the max of the bizTag to ARGV[1] plus ARGV[3] steps, ARGV[1]
+// being the max last served. The bizTag is created again with the step ARGV[2]
+// when it was lost, an archived bizTag is left as is and -1 is returned.
+var bumpLua = redis.NewScript(`
+local key = KEYS[1]
+local known = tonumber(ARGV[1])
+local steps = tonumber(ARGV[3])
+
+if redis.call("EXISTS", key) == 0 and redis.call("EXISTS", KEYS[2]) == 1 then
+	return -1
+end
+
+local step = tonumber(redis.call("HGET", key, "step"))
+if step == nil then
+	step = tonumber(ARGV[2])
+	redis.call("HSET", key, "step", step)
+end
+local max = tonumber(redis.call("HGET", key, "max"))
+if max == nil or max < known then
+	max = known
+end
+max = max + step * steps
+redis.call("HSET", key, "max", max)
+return max
+`)
+
+// getNextSegChecked runs getSegScript along with the read of the run_id. A
+// segment fetched from a master which changed is not used: the bizTags served
+// are bumped, then the segment is fetched again.
+func (this *RedisIdStore) getNextSegChecked(ctx context.Context, bizTag string, step int64, customStep int64) (*Seg, error) {
+	f := this.failover
+	for {
+		// The script is sent in full, EVALSHA cannot fall back to EVAL in a pipeline.
+		pipe := this.redisClient.Pipeline()
+		runId := f.runId(ctx, pipe)
+		res := getSegLua.Eval(ctx, pipe, this.keys(bizTag), step, customStep, this.creatable(bizTag))
+		_, _ = pipe.Exec(ctx) // The errors are those of the commands
+		seg, err := segResult(bizTag, res)
+		if err != nil {
+			return nil, err
+		}
+
+		newRunId, err := runId()
+		changed, err := f.check(newRunId, err)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]%w", bizTag, err)
+		}
+		if !changed {
+			f.served(seg)
+			return seg, nil
+		}
+		if err := this.bump(ctx, newRunId); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// bump raises the bizTags served after the master changed to runId. The
+// fetches which saw the change wait for it, it is done once.
+func (this *RedisIdStore) bump(ctx context.Context, runId string) error {
+	f := this.failover
+	f.bumpLock.Lock()
+	defer f.bumpLock.Unlock()
+
+	f.lock.Lock()
+	oldRunId := f.lastRunId
+	bizTags := maps.Clone(f.bizTags)
+	f.lock.Unlock()
+	if oldRunId == runId {
+		return nil
+	}
+
+	e := FailoverEvent{OldRunId: oldRunId, NewRunId: runId, Bumped: make(map[string]int64, len(bizTags))}
+	for bizTag, seg := range bizTags {
+		max, err := bumpLua.Run(ctx, this.redisClient, this.keys(bizTag), seg.MaxId, seg.Step, f.steps).Int64()
+		if err != nil {
+			return fmt.Errorf("[%s]bump after failover failed: %w", bizTag, err)
+		}
+		if max >= 0 {
+			e.Bumped[bizTag] = max
+		}
+	}
+
+	f.lock.Lock()
+	f.lastRunId = runId
+	f.lock.Unlock()
+
+	if f.onFailover != nil {
+		f.onFailover(e)
+	}
+	return nil
+}
+
+// check records runId read with a fetch, or returns err when it could not be
+// read. It reports whether the master changed and the bizTags are to be
+// bumped.
+func (this *failover) check(runId string, err error) (bool, error) {
+	this.lock.Lock()
+	lastRunId := this.lastRunId
+	if err == nil && lastRunId == "" {
+		this.lastRunId = runId
+	}
+	this.lock.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("read redis run_id failed: %w", err)
+		if this.onFailover != nil {
+			this.onFailover(FailoverEvent{OldRunId: lastRunId, Err: err})
+		}
+		return false, err
+	}
+	return lastRunId != "" && runId != lastRunId, nil
+}
+
+// served records seg as the last segment of its bizTag.
+func (this *failover) served(seg *Seg) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if last, ok := this.bizTags[seg.BizTag]; !ok || seg.MaxId > last.MaxId {
+		this.bizTags[seg.BizTag] = *seg
+	}
+}
+
+// serverRunId queues the read of the run_id of the redis server in pipe, it
+// changes when the server restarts or another one takes over. The returned
+// function reads it once pipe is run.
+func serverRunId(ctx context.Context, pipe redis.Pipeliner) func() (string, error) {
+	cmd := pipe.Info(ctx, "server")
+	return func() (string, error) {
+		info, err := cmd.Result()
+		if err != nil {
+			return "", err
+		}
+		return parseRunId(info)
+	}
+}
+
+// parseRunId returns the run_id of the reply of INFO server.
+func parseRunId(info string) (string, error) {
+	for _, line := range strings.Split(info, "\n") {
+		if runId, ok := strings.CutPrefix(strings.TrimSpace(line), "run_id:"); ok && runId != "" {
+			return runId, nil
+		}
+	}
+	return "", fmt.Errorf("no run_id in redis info")
+}
@@ -0,0 +1,96 @@
+package idgen
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisIdStore_FailoverBump(t *testing.T) {
+	assert := assert.New(t)
+	mr, client := newTestRedisClient(t)
+	ctx := context.Background()
+
+	var events []FailoverEvent
+	store := NewRedisIdStore(client, WithFailoverBump(2, func(e FailoverEvent) { events = append(events, e) }))
+	var runId atomic.Value
+	runId.Store("master-1")
+	store.failover.runId = func(ctx context.Context, pipe redis.Pipeliner) func() (string, error) {
+		return func() (string, error) { return runId.Load().(string), nil }
+	}
+
+	fetch := func(bizTag string, step int64) int64 {
+		seg, err := store.GetNextSegment(ctx, bizTag, step)
+		assert.Nil(err, "get seg err")
+		return seg.MaxId
+	}
+	assert.Equal(int64(100), fetch("a", 100))
+	assert.Equal(int64(10), fetch("b", 10))
+	assert.Nil(store.CreateBizTag(ctx, "c", 0, 10))
+	assert.Equal(int64(10), fetch("c", 10))
+	assert.Nil(store.ArchiveBizTag(ctx, "c"))
+	assert.Empty(events, "same master")
+
+	// The replica promoted lags behind: a lost its last segment, b was not
+	// replicated at all.
+	mr.HSet("idgen:a", "max", "0")
+	mr.Del("idgen:b")
+	runId.Store("master-2")
+
+	assert.Equal(int64(400), fetch("a", 100), "bumped above the max served by 2 steps")
+	assert.Equal(int64(40), fetch("b", 10), "created again above the max served")
+	if assert.Len(events, 1, "one failover") {
+		assert.Equal(FailoverEvent{OldRunId: "master-1", NewRunId: "master-2", Bumped: map[string]int64{"a": 300, "b": 30}}, events[0])
+	}
+	assert.False(mr.Exists("idgen:c"), "archived biztag should not be created again")
+}
+
+func TestRedisIdStore_FailoverBump_check(t *testing.T) {
+	assert := assert.New(t)
+	_, client := newTestRedisClient(t)
+	ctx := context.Background()
+
+	var events []FailoverEvent
+	store := NewRedisIdStore(client, WithFailoverBump(2, func(e FailoverEvent) { events = append(events, e) }))
+	var checks atomic.Int64
+	store.failover.runId = func(ctx context.Context, pipe redis.Pipeliner) func() (string, error) {
+		checks.Add(1)
+		return func() (string, error) { return "master-1", nil }
+	}
+
+	// test: the run_id is read with every fetch
+	for i := 0; i < 10; i++ {
+		_, err := store.GetNextSegment(ctx, "test", 10)
+		assert.Nil(err, "get seg err")
+	}
+	assert.Equal(int64(10), checks.Load(), "run_id checks")
+	assert.Empty(events)
+
+	// test: a run_id which can not be read fails the fetch, and is
+	// reported. miniredis does not support INFO server, like a server
+	// denying it by ACL.
+	store = NewRedisIdStore(client, WithFailoverBump(2, func(e FailoverEvent) { events = append(events, e) }))
+	for i := 0; i < 3; i++ {
+		seg, err := store.GetNextSegment(ctx, "test", 10)
+		assert.NotNil(err, "unchecked seg should fail")
+		assert.Nil(seg)
+	}
+	if assert.Len(events, 3, "failed checks") {
+		assert.NotNil(events[0].Err, "check err")
+		assert.Empty(events[0].Bumped)
+	}
+}
+
+func Test_parseRunId(t *testing.T) {
+	assert := assert.New(t)
+
+	runId, err := parseRunId("# Server\r\nredis_version:7.2.4\r\nrun_id:6f3c1e9a\r\ntcp_port:6379\r\n")
+	assert.Nil(err)
+	assert.Equal("6f3c1e9a", runId)
+
+	_, err = parseRunId("# Server\r\nredis_version:7.2.4\r\n")
+	assert.NotNil(err, "no run_id")
+}
@@ -0,0 +1,133 @@
+package idgen
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedisClient(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+	})
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return mr, client
+}
+
+func TestRedisIdStore_GetNextSegment(t *testing.T) {
+	assert := assert.New(t)
+	mr, client := newTestRedisClient(t)
+	store := NewRedisIdStore(client)
+	ctx := context.Background()
+
+	// test: the bizTag is created with the requested step
+	seg, err := store.GetNextSegment(ctx, "test", 100)
+	assert.Nil(err, "get seg err")
+	assert.Equal(int64(100), seg.MaxId, "max id of new biztag")
+	assert.Equal(int64(100), seg.Step, "step of new biztag")
+
+	// test: the step stored in redis wins over the requested one
+	mr.HSet("idgen:test", "step", "500")
+	seg, err = store.GetNextSegment(ctx, "test", 100)
+	assert.Nil(err, "get seg err")
+	assert.Equal(int64(600), seg.MaxId, "max id advanced by stored step")
+	assert.Equal(int64(500), seg.Step, "step should be the stored step")
+
+	// test: a custom step is used as is
+	seg, err = store.GetNextSegmentWithStep(ctx, "test", 1000)
+	assert.Nil(err, "get seg err")
+	assert.Equal(int64(1600), seg.MaxId, "max id advanced by custom step")
+	assert.Equal(int64(1000), seg.Step, "step should be the custom step")
+	assert.Equal("500", mr.HGet("idgen:test", "step"), "custom step should not be stored")
+}
+
+func TestRedisIdStore_StepMismatch(t *testing.T) {
+	assert := assert.New(t)
+	_, client := newTestRedisClient(t)
+	store := NewRedisIdStore(client)
+
+	// Two nodes configured with different steps share one bizTag,
+	// the ids must not overlap. The bizTag is created by the node with
+	// the smaller step, so the other node gets a smaller step than it asks.
+	idGenA := NewIdGenrator(store, WithStep(1000))
+	idGenB := NewIdGenrator(store, WithStep(10))
+
+	var res sync.Map
+	id, err := idGenB.GetId(context.Background(), "test")
+	assert.Nil(err, "get id err")
+	res.Store(id, 1)
+
+	wg := sync.WaitGroup{}
+	for _, idGen := range []*IdGenerator{idGenA, idGenB} {
+		wg.Add(1)
+		go func(idGen *IdGenerator) {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				id, err := idGen.GetId(context.Background(), "test")
+				assert.Nil(err, "get id err")
+				_, loaded := res.LoadOrStore(id, 1)
+				assert.Equal(false, loaded, "id duplication: %d", id)
+			}
+		}(idGen)
+	}
+	wg.Wait()
+}
+
+func TestRedisIdStore_Strict(t *testing.T) {
+	assert := assert.New(t)
+	mr, client := newTestRedisClient(t)
+	store := NewRedisIdStore(client, WithStrictBizTags("allowed"))
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		bizTag  string
+		wantErr error
+		wantMax int64
+	}{
+		{
+			name:    "test. unknown biztag is refused",
+			bizTag:  "typo",
+			wantErr: ErrUnknownBizTag,
+		},
+		{
+			name:    "test. allowlisted biztag is created",
+			bizTag:  "allowed",
+			wantMax: 100,
+		},
+		{
+			name:    "test. created biztag",
+			bizTag:  "created",
+			wantMax: 1100,
+		},
+	}
+	assert.Nil(store.CreateBizTag(ctx, "created", 1000, 100))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg, err := store.GetNextSegment(ctx, tt.bizTag, 100)
+			if tt.wantErr != nil {
+				assert.ErrorIs(err, tt.wantErr)
+				assert.False(mr.Exists("idgen:"+tt.bizTag), "should not be created")
+				return
+			}
+			assert.Nil(err, "get seg err")
+			assert.Equal(tt.wantMax, seg.MaxId)
+		})
+	}
+
+	// The generator fails at once, the store refusing the bizTag is not retried.
+	idGen := NewIdGenrator(store, WithPreloadRetryTimes(3), WithPreloadBackoff(time.Second, time.Second))
+	start := time.Now()
+	_, err := idGen.GetId(ctx, "typo")
+	assert.ErrorIs(err, ErrUnknownBizTag)
+	assert.NotErrorIs(err, ErrStoreUnavailable)
+	assert.Less(time.Since(start), time.Second, "should not be retried")
+}
@@ -0,0 +1,190 @@
+package idgen
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// WatermarkStore keeps the high water mark of each bizTag, the largest max
+// id of the segments fetched from the id store. It is kept apart from the id
+// store, so that it survives the loss or the rollback of the bizTags there.
+type WatermarkStore interface {
+	// Get returns the mark of bizTag, 0 when there is none.
+	Get(ctx context.Context, bizTag string) (int64, error)
+	// Save raises the mark of bizTag to max, a lower max is ignored.
+	Save(ctx context.Context, bizTag string, max int64) error
+}
+
+// WatermarkPolicy is what IdGenerator does with a segment from the store
+// which is not above the mark of its bizTag.
+type WatermarkPolicy int
+
+const (
+	// WatermarkRefuse fails the fetch with ErrBelowWatermark.
+	WatermarkRefuse WatermarkPolicy = iota
+	// WatermarkBump advances the bizTag in the store past the mark and uses
+	// the segment above it. It requires a DynamicStepStore, it refuses otherwise.
+	WatermarkBump
+)
+
+// WithWatermark checks each segment fetched against the high water mark of
+// its bizTag in store. A segment with ids not above the mark means the store
+// lost or rolled back the bizTag, it is handled by policy and reported by an
+// EventWatermarkViolated. The mark is raised before a segment is used.
+func WithWatermark(store WatermarkStore, policy WatermarkPolicy) Option {
+	return func(idgen *IdGenerator) {
+		idgen.watermark = store
+		idgen.watermarkPolicy = policy
+	}
+}
+
+// aboveWatermark returns seg, or the segment which replaces it, after the
+// mark of its bizTag is raised to it.
+func (this *IdGenerator) aboveWatermark(ctx context.Context, seg *Seg) (*Seg, error) {
+	if this.watermark == nil {
+		return seg, nil
+	}
+
+	mark, err := this.watermark.Get(ctx, seg.BizTag)
+	if err != nil {
+		return nil, fmt.Errorf("[%s]get high water mark failed: %w", seg.BizTag, err)
+	}
+	if seg.MaxId-seg.Step < mark {
+		violation := fmt.Errorf("[%s]%w, seg: (%d, %d], mark: %d", seg.BizTag, ErrBelowWatermark, seg.MaxId-seg.Step, seg.MaxId, mark)
+		this.observers.Observe(Event{Type: EventWatermarkViolated, BizTag: seg.BizTag, MinId: seg.MaxId - seg.Step, MaxId: seg.MaxId, Err: violation})
+
+		if seg, err = this.bump(ctx, seg, mark); err != nil {
+			if errors.Is(err, ErrBelowWatermark) {
+				return nil, violation
+			}
+			return nil, err
+		}
+	}
+
+	if err := this.watermark.Save(ctx, seg.BizTag, seg.MaxId); err != nil {
+		return nil, fmt.Errorf("[%s]save high water mark failed: %w", seg.BizTag, err)
+	}
+	return seg, nil
+}
+
+// bump advances the bizTag of seg past mark with WatermarkBump, and returns
+// the segment above mark. The ids between seg and mark are skipped.
+func (this *IdGenerator) bump(ctx context.Context, seg *Seg, mark int64) (*Seg, error) {
+	dynamicStore, ok := this.store.(DynamicStepStore)
+	if this.watermarkPolicy != WatermarkBump || !ok {
+		return nil, ErrBelowWatermark
+	}
+
+	// The store ends at seg.MaxId, advancing it by mark-seg.MaxId skips to
+	// the mark, and by seg.Step more gives a segment as large as seg.
+	bumped, err := dynamicStore.GetNextSegmentWithStep(ctx, seg.BizTag, mark-seg.MaxId+seg.Step)
+	if err != nil {
+		return nil, err
+	}
+	if err := bumped.check(); err != nil {
+		return nil, err
+	}
+
+	// Only the top of the bumped segment is used, it is above the mark
+	// even when the store was advanced meanwhile.
+	step := min(bumped.Step, seg.Step)
+	if bumped.MaxId-step < mark {
+		return nil, ErrBelowWatermark
+	}
+	return &Seg{BizTag: seg.BizTag, MaxId: bumped.MaxId, Step: step}, nil
+}
+
+// FileWatermarkStore is a WatermarkStore in a local JSON file, the marks of
+// the bizTags by name. Each node needs a file of its own, the marks cover the
+// segments fetched by the node.
+//
+// It only protects a single node deployment. With several nodes, the ids
+// above the mark of a node may have been handed out by the others, which
+// WatermarkBump cannot see: it may advance the bizTag right into them. Use
+// WatermarkRefuse with it, or a WatermarkStore shared by the nodes.
+type FileWatermarkStore struct {
+	path string
+
+	lock  sync.Mutex
+	marks map[string]int64
+}
+
+// NewFileWatermarkStore returns the store of the marks in the file at path,
+// which is created when the first mark is saved.
+func NewFileWatermarkStore(path string) (*FileWatermarkStore, error) {
+	store := &FileWatermarkStore{
+		path:  path,
+		marks: make(map[string]int64),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.marks); err != nil {
+		return nil, fmt.Errorf("invalid watermark file %s: %w", path, err)
+	}
+	return store, nil
+}
+
+func (this *FileWatermarkStore) Get(ctx context.Context, bizTag string) (int64, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.marks[bizTag], nil
+}
+
+// Save writes the marks to a temporary file which replaces the file, so that
+// a crash leaves either the old marks or the new ones.
+func (this *FileWatermarkStore) Save(ctx context.Context, bizTag string, max int64) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if max <= this.marks[bizTag] {
+		return nil
+	}
+	prev, ok := this.marks[bizTag]
+	this.marks[bizTag] = max
+	if err := this.write(); err != nil {
+		if ok {
+			this.marks[bizTag] = prev
+		} else {
+			delete(this.marks, bizTag)
+		}
+		return err
+	}
+	return nil
+}
+
+func (this *FileWatermarkStore) write() error {
+	data, err := json.Marshal(this.marks)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(this.path), filepath.Base(this.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), this.path)
+}
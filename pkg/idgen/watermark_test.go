@@ -0,0 +1,119 @@
+package idgen
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileWatermarkStore(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "watermark.json")
+
+	store, err := NewFileWatermarkStore(path)
+	assert.Nil(err, "new store err")
+	mark, err := store.Get(ctx, "test")
+	assert.Nil(err, "get err")
+	assert.Equal(int64(0), mark, "no mark yet")
+
+	assert.Nil(store.Save(ctx, "test", 100))
+	assert.Nil(store.Save(ctx, "test", 50), "a lower max is ignored")
+	assert.Nil(store.Save(ctx, "other", 10))
+
+	// test: the marks survive a restart
+	store, err = NewFileWatermarkStore(path)
+	assert.Nil(err, "reload err")
+	mark, _ = store.Get(ctx, "test")
+	assert.Equal(int64(100), mark)
+	mark, _ = store.Get(ctx, "other")
+	assert.Equal(int64(10), mark)
+
+	assert.Nil(os.WriteFile(path, []byte("{"), 0644))
+	_, err = NewFileWatermarkStore(path)
+	assert.NotNil(err, "invalid file")
+}
+
+func TestWithWatermark(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		policy    WatermarkPolicy
+		lose      func(mr *miniredis.Miniredis) // Redis loses or rolls back the bizTag
+		wantId    int64
+		wantErr   error
+		wantEvent bool
+	}{
+		{
+			name:   "test. no loss",
+			policy: WatermarkRefuse,
+			lose:   func(mr *miniredis.Miniredis) {},
+			wantId: 11,
+		},
+		{
+			name:      "test. key lost, bump",
+			policy:    WatermarkBump,
+			lose:      func(mr *miniredis.Miniredis) { mr.Del("idgen:test") },
+			wantId:    11,
+			wantEvent: true,
+		},
+		{
+			name:      "test. key lost, refuse",
+			policy:    WatermarkRefuse,
+			lose:      func(mr *miniredis.Miniredis) { mr.Del("idgen:test") },
+			wantErr:   ErrBelowWatermark,
+			wantEvent: true,
+		},
+		{
+			name:      "test. max rolled back, bump",
+			policy:    WatermarkBump,
+			lose:      func(mr *miniredis.Miniredis) { mr.HSet("idgen:test", "max", "5") },
+			wantId:    16,
+			wantEvent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr, client := newTestRedisClient(t)
+			marks, err := NewFileWatermarkStore(filepath.Join(t.TempDir(), "watermark.json"))
+			assert.Nil(err, "new store err")
+			violated := newEventRecorder(EventWatermarkViolated)
+			idGen := NewIdGenrator(NewRedisIdStore(client), WithStep(10), WithWatermark(marks, tt.policy), WithObserver(violated))
+
+			id, err := idGen.GetId(ctx, "test")
+			assert.Nil(err, "get id err")
+			assert.Equal(int64(1), id)
+			mark, _ := marks.Get(ctx, "test")
+			assert.Equal(int64(10), mark, "mark of the first segment")
+
+			tt.lose(mr)
+			idGen.RemoveBizTag("test")
+
+			id, err = idGen.GetId(ctx, "test")
+			if tt.wantErr != nil {
+				assert.ErrorIs(err, tt.wantErr)
+				assert.NotErrorIs(err, ErrStoreUnavailable)
+			} else {
+				assert.Nil(err, "get id err")
+				assert.Equal(tt.wantId, id)
+			}
+
+			events := violated.get()
+			if !tt.wantEvent {
+				assert.Empty(events, "no violation")
+				return
+			}
+			if assert.Len(events, 1, "violation event") {
+				assert.Equal("test", events[0].BizTag)
+				assert.LessOrEqual(events[0].MinId, int64(10), "the segment below the mark")
+				assert.ErrorIs(events[0].Err, ErrBelowWatermark)
+			}
+		})
+	}
+}
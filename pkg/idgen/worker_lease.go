@@ -0,0 +1,272 @@
+package idgen
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	DefaultLeaseTTL       = 30 * time.Second // default time a worker id lease lasts without renewal
+	DefaultLeaseKeyPrefix = "idgen:worker:"  // default redis key prefix of worker id leases
+)
+
+var (
+	ErrNoFreeWorkerId = errors.New("no free worker id")
+	ErrLeaseLost      = errors.New("worker id lease lost")
+)
+
+// WorkerLease guards the worker id of a SnowflakeGenerator. While Valid
+// returns an error, the generator refuses to generate ids.
+type WorkerLease interface {
+	Valid() error
+}
+
+// claimScript sets the first free worker id key, starting from ARGV[3],
+// and returns the worker id, -1 when all worker ids are taken.
+var claimScript = `
+local prefix = ARGV[1]
+local owner = ARGV[2]
+local start = tonumber(ARGV[3])
+local maxWorkers = tonumber(ARGV[4])
+local ttl = ARGV[5]
+
+for i = 0, maxWorkers - 1 do
+	local id = (start + i) % maxWorkers
+	if redis.call("SET", prefix .. id, owner, "NX", "PX", ttl) then
+		return id
+	end
+end
+return -1
+`
+
+// renewScript extends the lease only when it is still held by the owner.
+var renewScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`
+
+// releaseScript deletes the lease only when it is still held by the owner.
+var releaseScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
+var (
+	claimLua   = redis.NewScript(claimScript)
+	renewLua   = redis.NewScript(renewScript)
+	releaseLua = redis.NewScript(releaseScript)
+)
+
+// RedisWorkerLease claims a worker id in [0, maxWorkers) through redis, so that
+// instances do not need a hand assigned worker id.
+//
+// The lease is a key with a ttl, renewed by a heartbeat every ttl/3. The lease
+// is considered valid only until ttl after the last successful renewal was
+// sent, which is never later than the key expires in redis, so a worker id is
+// never used by two instances at once. Once the key is found held by another
+// owner or gone, the lease is lost for good and Valid returns ErrLeaseLost.
+type RedisWorkerLease struct {
+	redisClient *redis.Client
+	keyPrefix   string
+	maxWorkers  int64
+	ttl         time.Duration
+	owner       string // Random token identifying this holder
+
+	mutex    sync.Mutex
+	workerId int64
+	expireAt time.Time // Local deadline of the lease
+	lost     bool
+	released bool // Release was called, the heartbeat is stopped once
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type WorkerLeaseOption func(*RedisWorkerLease)
+
+func WithLeaseTTL(ttl time.Duration) WorkerLeaseOption {
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	return func(lease *RedisWorkerLease) {
+		lease.ttl = ttl
+	}
+}
+
+func WithLeaseKeyPrefix(prefix string) WorkerLeaseOption {
+	return func(lease *RedisWorkerLease) {
+		lease.keyPrefix = prefix
+	}
+}
+
+// NewRedisWorkerLease creates a lease over worker ids [0, maxWorkers), which
+// must be 1 << worker bits of the SnowflakeGenerator it guards.
+func NewRedisWorkerLease(client *redis.Client, maxWorkers int64, opts ...WorkerLeaseOption) (*RedisWorkerLease, error) {
+	if maxWorkers <= 0 {
+		return nil, fmt.Errorf("invalid worker id lease max workers %d", maxWorkers)
+	}
+	lease := &RedisWorkerLease{
+		redisClient: client,
+		keyPrefix:   DefaultLeaseKeyPrefix,
+		maxWorkers:  maxWorkers,
+		ttl:         DefaultLeaseTTL,
+		owner:       newLeaseOwner(),
+		workerId:    -1,
+	}
+
+	for _, o := range opts {
+		o(lease)
+	}
+	return lease, nil
+}
+
+// Acquire claims a free worker id and starts the heartbeat.
+func (this *RedisWorkerLease) Acquire(ctx context.Context) (int64, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.workerId >= 0 {
+		return 0, fmt.Errorf("worker id %d already acquired", this.workerId)
+	}
+
+	start := time.Now()
+	offset := start.UnixNano() % this.maxWorkers
+	workerId, err := claimLua.Run(ctx, this.redisClient, nil,
+		this.keyPrefix, this.owner, offset, this.maxWorkers, this.ttl.Milliseconds()).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if workerId < 0 {
+		return 0, ErrNoFreeWorkerId
+	}
+
+	this.workerId = workerId
+	this.expireAt = start.Add(this.ttl)
+	this.lost = false // Lost by the last Release
+	this.released = false
+	this.stop = make(chan struct{})
+	this.done = make(chan struct{})
+	go this.heartbeat()
+
+	return workerId, nil
+}
+
+// MaxWorkers returns the number of worker ids the lease claims from.
+func (this *RedisWorkerLease) MaxWorkers() int64 {
+	return this.maxWorkers
+}
+
+func (this *RedisWorkerLease) WorkerId() int64 {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.workerId
+}
+
+// Valid returns ErrLeaseLost when the lease is lost or not renewed in time.
+func (this *RedisWorkerLease) Valid() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.workerId < 0 || this.lost {
+		return ErrLeaseLost
+	}
+	if !time.Now().Before(this.expireAt) {
+		return fmt.Errorf("%w: not renewed since %v", ErrLeaseLost, this.expireAt.Add(-this.ttl))
+	}
+	return nil
+}
+
+// Release stops the heartbeat and frees the worker id. It is safe to call
+// concurrently, the calls after the first one do nothing.
+func (this *RedisWorkerLease) Release(ctx context.Context) error {
+	this.mutex.Lock()
+	if this.workerId < 0 || this.released {
+		this.mutex.Unlock()
+		return nil
+	}
+	this.released = true
+	stop, done := this.stop, this.done
+	this.mutex.Unlock()
+
+	close(stop)
+	<-done
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	workerId := this.workerId
+	this.workerId = -1
+	this.lost = true
+
+	return releaseLua.Run(ctx, this.redisClient, []string{this.genRedisKey(workerId)}, this.owner).Err()
+}
+
+func (this *RedisWorkerLease) heartbeat() {
+	defer close(this.done)
+
+	interval := this.ttl / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !this.renew(interval) {
+			return
+		}
+	}
+}
+
+// renew extends the lease, it returns false when the lease is lost.
+func (this *RedisWorkerLease) renew(timeout time.Duration) bool {
+	this.mutex.Lock()
+	key := this.genRedisKey(this.workerId)
+	this.mutex.Unlock()
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	res, err := renewLua.Run(ctx, this.redisClient, []string{key}, this.owner, this.ttl.Milliseconds()).Int64()
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if err != nil {
+		// Keep trying, the lease turns invalid by itself when expireAt passes.
+		return true
+	}
+	if res != 1 {
+		this.lost = true
+		return false
+	}
+	this.expireAt = start.Add(this.ttl)
+	return true
+}
+
+func (this *RedisWorkerLease) genRedisKey(workerId int64) string {
+	return fmt.Sprintf("%s%d", this.keyPrefix, workerId)
+}
+
+func newLeaseOwner() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
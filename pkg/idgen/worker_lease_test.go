@@ -0,0 +1,143 @@
+package idgen
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisWorkerLease_Acquire(t *testing.T) {
+	assert := assert.New(t)
+	_, client := newTestRedisClient(t)
+	ctx := context.Background()
+
+	var maxWorkers int64 = 8
+	leases := make([]*RedisWorkerLease, 0, maxWorkers)
+	workerIds := make(map[int64]bool)
+	for i := int64(0); i < maxWorkers; i++ {
+		lease, err := NewRedisWorkerLease(client, maxWorkers)
+		assert.Nil(err, "new lease err")
+		workerId, err := lease.Acquire(ctx)
+		assert.Nil(err, "acquire err")
+		assert.False(workerIds[workerId], "worker id %d claimed twice", workerId)
+		assert.Nil(lease.Valid(), "lease should be valid")
+		workerIds[workerId] = true
+		leases = append(leases, lease)
+	}
+
+	// test: all worker ids are taken
+	lease, err := NewRedisWorkerLease(client, maxWorkers)
+	assert.Nil(err, "new lease err")
+	_, err = lease.Acquire(ctx)
+	assert.True(errors.Is(err, ErrNoFreeWorkerId), "acquire should fail, err: %v", err)
+
+	// test: a released worker id can be claimed again
+	released := leases[3].WorkerId()
+	assert.Nil(leases[3].Release(ctx), "release err")
+	assert.NotNil(leases[3].Valid(), "released lease should be invalid")
+
+	workerId, err := lease.Acquire(ctx)
+	assert.Nil(err, "acquire err")
+	assert.Equal(released, workerId, "released worker id not claimed")
+
+	// test: a released lease can be acquired again and is valid
+	assert.Nil(leases[0].Release(ctx), "release err")
+	_, err = leases[0].Acquire(ctx)
+	assert.Nil(err, "acquire after release err")
+	assert.Nil(leases[0].Valid(), "lease acquired again should be valid")
+
+	// test: concurrent releases stop the heartbeat once
+	wg := sync.WaitGroup{}
+	for _, l := range append(leases, lease) {
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(l *RedisWorkerLease) {
+				defer wg.Done()
+				assert.Nil(l.Release(ctx), "release err")
+			}(l)
+		}
+	}
+	wg.Wait()
+}
+
+func TestNewRedisWorkerLease(t *testing.T) {
+	assert := assert.New(t)
+	_, client := newTestRedisClient(t)
+
+	_, err := NewRedisWorkerLease(client, 0)
+	assert.NotNil(err, "zero max workers should fail")
+	_, err = NewRedisWorkerLease(client, -1)
+	assert.NotNil(err, "negative max workers should fail")
+
+	// test: the lease must cover the worker ids of the snowflake layout
+	lease, err := NewRedisWorkerLease(client, 1<<8)
+	assert.Nil(err, "new lease err")
+	_, err = NewSnowflakeGenerator(0, WithWorkerLease(lease))
+	assert.NotNil(err, "lease over fewer worker ids than the layout should fail")
+	_, err = NewSnowflakeGenerator(0, WithSnowflakeLayout(41, 8, 14), WithWorkerLease(lease))
+	assert.Nil(err, "lease matching the layout")
+}
+
+func TestRedisWorkerLease_Lost(t *testing.T) {
+	assert := assert.New(t)
+	mr, client := newTestRedisClient(t)
+	ctx := context.Background()
+
+	lease, err := NewRedisWorkerLease(client, 4, WithLeaseTTL(300*time.Millisecond))
+	assert.Nil(err, "new lease err")
+	workerId, err := lease.Acquire(ctx)
+	assert.Nil(err, "acquire err")
+
+	// test: the heartbeat keeps the lease valid beyond ttl
+	time.Sleep(500 * time.Millisecond)
+	assert.Nil(lease.Valid(), "lease should be renewed")
+
+	// test: the lease is lost once the key is taken by another owner
+	mr.Set(lease.genRedisKey(workerId), "another")
+	time.Sleep(200 * time.Millisecond)
+	assert.True(errors.Is(lease.Valid(), ErrLeaseLost), "lease should be lost")
+	assert.Nil(lease.Release(ctx), "release err")
+	assert.Equal("another", mustGet(t, mr.Get, lease.genRedisKey(workerId)), "release should not delete others' lease")
+}
+
+func TestRedisWorkerLease_RenewFail(t *testing.T) {
+	assert := assert.New(t)
+	mr, client := newTestRedisClient(t)
+	ctx := context.Background()
+
+	lease, err := NewRedisWorkerLease(client, 4, WithLeaseTTL(300*time.Millisecond))
+	assert.Nil(err, "new lease err")
+	_, err = lease.Acquire(ctx)
+	assert.Nil(err, "acquire err")
+
+	sf, err := NewSnowflakeGenerator(lease.WorkerId(), WithSnowflakeLayout(41, 2, 12), WithWorkerLease(lease))
+	assert.Nil(err, "new snowflake generator err")
+	_, err = sf.GetId(ctx, "test")
+	assert.Nil(err, "get id err")
+
+	// test: generation stops when the lease can not be renewed in time
+	mr.SetError("redis down")
+	time.Sleep(400 * time.Millisecond)
+	_, err = sf.GetId(ctx, "test")
+	assert.True(errors.Is(err, ErrLeaseLost), "get id should fail, err: %v", err)
+
+	// test: the lease comes back once renewed, the key is still held
+	mr.SetError("")
+	time.Sleep(200 * time.Millisecond)
+	_, err = sf.GetId(ctx, "test")
+	assert.Nil(err, "get id err")
+
+	lease.Release(ctx)
+}
+
+func mustGet(t *testing.T, get func(string) (string, error), key string) string {
+	v, err := get(key)
+	if err != nil {
+		t.Fatalf("get %s err: %v", key, err)
+	}
+	return v
+}